@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// certFile serves a certificate kept on disk, like one renewed by an external tool, and picks up new versions by
+// watching the modification times of the files.
+type certFile struct {
+	certFile string
+	keyFile  string
+
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+func newCertFile(ctx context.Context, logger *slog.Logger, certPath, keyPath string) (*certFile, error) {
+	c := &certFile{certFile: certPath, keyFile: keyPath}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	go c.watch(ctx, logger, 10*time.Second)
+
+	return c, nil
+}
+
+// load reads the pair again if either file changed. A pair that does not match, like one caught halfway through
+// being replaced, is reported and tried again on the next check while the previous certificate stays in use.
+func (c *certFile) load() error {
+	modified := time.Time{}
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+
+	c.lock.RLock()
+	current := c.modified
+	c.lock.RUnlock()
+
+	if !modified.After(current) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cert, c.modified = &cert, modified
+	return nil
+}
+
+func (c *certFile) watch(ctx context.Context, logger *slog.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.load(); err != nil {
+				logger.Error("failed to reload certificate", err)
+			}
+		}
+	}
+}
+
+func (c *certFile) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.cert, nil
+}
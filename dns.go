@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/libdns/cloudflare"
+	"github.com/libdns/porkbun"
+	"github.com/sethvargo/go-envconfig"
+)
+
+// dnsProviders builds the libdns provider picked by DNS_PROVIDER for the DNS-01 challenge, each reads its own
+// credentials from the environment. Supporting another provider takes one entry here.
+var dnsProviders = map[string]func(ctx context.Context) (certmagic.ACMEDNSProvider, error){
+	// a scoped token with Zone:Read and DNS:Edit, not the global API key
+	"cloudflare": func(ctx context.Context) (certmagic.ACMEDNSProvider, error) {
+		env := struct {
+			APIToken string `env:"CLOUDFLARE_API_TOKEN"`
+		}{}
+
+		if err := envconfig.Process(ctx, &env); err != nil {
+			return nil, err
+		}
+
+		if env.APIToken == "" {
+			return nil, errors.New("CLOUDFLARE_API_TOKEN is required")
+		}
+
+		return &cloudflare.Provider{APIToken: env.APIToken}, nil
+	},
+	"porkbun": func(ctx context.Context) (certmagic.ACMEDNSProvider, error) {
+		env := struct {
+			APIKey       string `env:"PORKBUN_API_KEY"`
+			APISecretKey string `env:"PORKBUN_API_SECRET"`
+		}{}
+
+		if err := envconfig.Process(ctx, &env); err != nil {
+			return nil, err
+		}
+
+		if env.APIKey == "" || env.APISecretKey == "" {
+			return nil, errors.New("PORKBUN_API_KEY and PORKBUN_API_SECRET are required")
+		}
+
+		return &porkbun.Provider{APIKey: env.APIKey, APISecretKey: env.APISecretKey}, nil
+	},
+}
+
+func dnsProvider(ctx context.Context, name string) (certmagic.ACMEDNSProvider, error) {
+	provider, ok := dnsProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown dns provider %v", name)
+	}
+
+	return provider(ctx)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libdns/cloudflare"
+	"github.com/libdns/porkbun"
+)
+
+func TestDNSProvider(t *testing.T) {
+	ctx := context.Background()
+
+	t.Setenv("CLOUDFLARE_API_TOKEN", "")
+	if _, err := dnsProvider(ctx, "cloudflare"); err == nil {
+		t.Error("picked cloudflare without a token")
+	}
+
+	t.Setenv("CLOUDFLARE_API_TOKEN", "token")
+	provider, err := dnsProvider(ctx, "cloudflare")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p, ok := provider.(*cloudflare.Provider); !ok || p.APIToken != "token" {
+		t.Errorf("wrong provider %#v", provider)
+	}
+
+	t.Setenv("PORKBUN_API_KEY", "key")
+	t.Setenv("PORKBUN_API_SECRET", "secret")
+	if provider, err := dnsProvider(ctx, "porkbun"); err != nil {
+		t.Fatal(err)
+	} else if _, ok := provider.(*porkbun.Provider); !ok {
+		t.Errorf("wrong provider %#v", provider)
+	}
+
+	if _, err := dnsProvider(ctx, "unknown"); err == nil {
+		t.Error("picked an unknown provider")
+	}
+}
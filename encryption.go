@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// keyring holds the versioned keys certificates are encrypted with at rest. Every entry gets its own data key, only
+// that is encrypted with the current key of the ring, so rotating means re-wrapping data keys.
+type keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// sealed is an entry as it is kept in redis, the version names the key that wrapped the data key.
+type sealed struct {
+	version string
+	dataKey []byte
+	data    []byte
+}
+
+// newKeyring reads "version:base64 key" pairs separated by commas or new lines, from TLS_STORAGE_KEYS and the file
+// TLS_STORAGE_KEYS_FILE. The first key encrypts, the others are only kept to decrypt what they encrypted. Without
+// keys nil is returned and entries are stored as they are.
+func newKeyring(envTLS EnvTLS) (*keyring, error) {
+	entries := envTLS.TLSStorageKeys
+	if envTLS.TLSStorageKeysFile != "" {
+		b, err := os.ReadFile(envTLS.TLSStorageKeysFile)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, strings.FieldsFunc(string(b), func(r rune) bool { return r == ',' || r == '\n' })...)
+	}
+
+	ring := &keyring{keys: make(map[string]cipher.AEAD)}
+
+	for _, entry := range entries {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		version, encoded, ok := strings.Cut(entry, ":")
+		if !ok || version == "" {
+			return nil, errors.New("storage keys need a version, like 1:base64key")
+		}
+
+		if _, ok := ring.keys[version]; ok {
+			return nil, fmt.Errorf("storage key %v given twice", version)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("storage key %v: %w", version, err)
+		}
+
+		if len(key) != 32 {
+			return nil, fmt.Errorf("storage key %v has to be 32 bytes", version)
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if ring.current == "" {
+			ring.current = version
+		}
+
+		ring.keys[version] = aead
+	}
+
+	if ring.current == "" {
+		return nil, nil
+	}
+
+	return ring, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts value under a fresh data key. The name of the entry is authenticated along, so entries can not be
+// swapped.
+func (k *keyring) seal(name string, value []byte) (sealed, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return sealed{}, err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return sealed{}, err
+	}
+
+	data, err := encrypt(aead, name, value)
+	if err != nil {
+		return sealed{}, err
+	}
+
+	wrapped, err := encrypt(k.keys[k.current], name, dataKey)
+	if err != nil {
+		return sealed{}, err
+	}
+
+	return sealed{version: k.current, dataKey: wrapped, data: data}, nil
+}
+
+func (k *keyring) open(name string, s sealed) ([]byte, error) {
+	kek, ok := k.keys[s.version]
+	if !ok {
+		return nil, fmt.Errorf("no storage key %v", s.version)
+	}
+
+	dataKey, err := decrypt(kek, name, s.dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return decrypt(aead, name, s.data)
+}
+
+// encrypt puts the nonce in front of the ciphertext.
+func encrypt(aead cipher.AEAD, name string, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, []byte(name)), nil
+}
+
+func decrypt(aead cipher.AEAD, name string, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(name))
+}
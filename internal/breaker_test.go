@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := NewBreaker(2, 20*time.Millisecond)
+
+	b.Failure()
+	if b.Allow() != nil {
+		t.Error("breaker opened below threshold")
+	}
+
+	b.Failure()
+	if b.Allow() != ErrBreakerOpen || b.State() != BreakerOpen {
+		t.Error("breaker did not open at threshold")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if b.Allow() != nil {
+		t.Error("breaker did not let a probe through after cooldown")
+	}
+
+	if b.Allow() != ErrBreakerOpen {
+		t.Error("breaker let a second probe through")
+	}
+
+	b.Failure()
+	if b.State() != BreakerOpen {
+		t.Error("failed probe did not reopen breaker")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	_ = b.Allow()
+	b.Success()
+	if b.State() != BreakerClosed || b.Allow() != nil {
+		t.Error("successful probe did not close breaker")
+	}
+
+	b.Failure()
+	b.Failure()
+	time.Sleep(30 * time.Millisecond)
+	_ = b.Allow()
+
+	// a canceled probe tells nothing, the next call probes instead
+	b.Release()
+	if b.State() != BreakerHalfOpen || b.Allow() != nil {
+		t.Error("canceled probe kept the breaker from probing again")
+	}
+
+	if b.Allow() != ErrBreakerOpen {
+		t.Error("breaker let a second probe through after a release")
+	}
+}
@@ -0,0 +1,384 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+// Bus carries cluster events between instances. Channels are either an instance ID or the broadcast channel.
+type Bus interface {
+	Publish(ctx context.Context, channel string, event Event) error
+	// Subscribe blocks until ctx is done, handing every event to handler. The handler calls ack once the event has
+	// been delivered, buses that can redeliver use it to decide what is still outstanding.
+	Subscribe(ctx context.Context, channels []string, handler func(event Event, ack func()))
+	// Close gives up what the instance keeps on the bus, once it is shutting down and has no connections left. Events
+	// still outstanding are kept for the instance to recover when it restarts.
+	Close(ctx context.Context) error
+}
+
+func NewBus(logger *slog.Logger, rdb redis.UniversalClient, instanceID string, cfg Config) (Bus, error) {
+	_, sharded := rdb.(*redis.ClusterClient)
+
+	switch cfg.Bus {
+	case "", "pubsub":
+		return instrumentedBus{&PubSubBus{logger: logger, rdb: rdb, sharded: sharded}}, nil
+	case "streams":
+		bus := &StreamBus{
+			logger:    logger,
+			rdb:       rdb,
+			group:     instanceID,
+			maxLen:    cfg.StreamMaxLen,
+			retention: cfg.StreamRetention,
+		}
+
+		return instrumentedBus{bus}, nil
+	default:
+		return nil, fmt.Errorf("unknown bus %v", cfg.Bus)
+	}
+}
+
+// PubSubBus is fire and forget, events for an instance that is not subscribed at the time are lost.
+//
+// On a cluster, classic pub/sub sends every message to every node. Instance channels are sharded instead, so their
+// messages only travel to the node owning the slot. The broadcast channel stays classic, it is meant for everyone.
+type PubSubBus struct {
+	logger  *slog.Logger
+	rdb     redis.UniversalClient
+	sharded bool
+}
+
+func (b *PubSubBus) Publish(ctx context.Context, channel string, event Event) error {
+	bEvent, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if b.sharded && channel != broadcastChannel {
+		return b.rdb.SPublish(ctx, channel, string(bEvent)).Err()
+	}
+
+	return b.rdb.Publish(ctx, channel, string(bEvent)).Err()
+}
+
+func (b *PubSubBus) Close(context.Context) error {
+	return nil
+}
+
+func (b *PubSubBus) Subscribe(ctx context.Context, channels []string, handler func(event Event, ack func())) {
+	subs := make([]*redis.PubSub, 0, 2)
+	if b.sharded {
+		sharded := make([]string, 0, len(channels))
+		for _, channel := range channels {
+			if channel == broadcastChannel {
+				subs = append(subs, b.rdb.Subscribe(ctx, channel))
+			} else {
+				sharded = append(sharded, channel)
+			}
+		}
+
+		if len(sharded) > 0 {
+			subs = append(subs, b.rdb.SSubscribe(ctx, sharded...))
+		}
+	} else {
+		subs = append(subs, b.rdb.Subscribe(ctx, channels...))
+	}
+
+	ch := make(chan *redis.Message)
+	for _, sub := range subs {
+		go func(messages <-chan *redis.Message) {
+			for msg := range messages {
+				select {
+				case ch <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(sub.Channel())
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for _, sub := range subs {
+				_ = sub.Close()
+			}
+			return
+		case msg := <-ch:
+			event := Event{}
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				b.logger.Error("failed to unmarshal cluster event", err)
+				continue
+			}
+
+			handler(event, func() {})
+		}
+	}
+}
+
+// StreamBus keeps one stream per channel. Every instance reads through its own consumer group, so the broadcast
+// stream fans out to all of them while an instance stream is only ever read by its owner. Entries stay pending
+// until acknowledged and are picked up again when the instance restarts with the same ID.
+//
+// Streams are read one at a time, a single XREADGROUP over several of them fails on a cluster when they hash to
+// different slots.
+//
+// Streams are capped at maxLen entries. An instance removes its stream and its group on the broadcast stream when
+// it closes after draining with nothing left pending. One that died, or closed with entries pending, keeps them until
+// its alive key has not been refreshed for the retention, then any other instance sweeps them away, pending entries
+// included.
+type StreamBus struct {
+	logger    *slog.Logger
+	rdb       redis.UniversalClient
+	group     string
+	maxLen    int64
+	retention time.Duration
+	closed    atomic.Bool
+}
+
+// appendScript adds to a stream that exists, XADD NOMKSTREAM is not understood everywhere.
+var appendScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+if tonumber(ARGV[1]) > 0 then
+	redis.call("XADD", KEYS[1], "MAXLEN", "~", ARGV[1], "*", "event", ARGV[2])
+else
+	redis.call("XADD", KEYS[1], "*", "event", ARGV[2])
+end
+return 1
+`)
+
+func streamKey(channel string) string {
+	return fmt.Sprintf("stream:%v", channel)
+}
+
+func streamAliveKey(group string) string {
+	return fmt.Sprintf("stream-alive:%v", group)
+}
+
+func (b *StreamBus) Publish(ctx context.Context, channel string, event Event) error {
+	bEvent, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	// an instance stream only exists while its instance does, events for one that is gone are dropped
+	if channel != broadcastChannel {
+		return appendScript.Run(ctx, b.rdb, []string{streamKey(channel)}, b.maxLen, string(bEvent)).Err()
+	}
+
+	args := &redis.XAddArgs{
+		Stream: streamKey(channel),
+		MaxLen: b.maxLen,
+		Approx: true,
+		Values: map[string]any{"event": string(bEvent)},
+	}
+
+	return b.rdb.XAdd(ctx, args).Err()
+}
+
+func (b *StreamBus) Subscribe(ctx context.Context, channels []string, handler func(event Event, ack func())) {
+	wg := sync.WaitGroup{}
+
+	// marked alive before the groups exist, so no sweep takes them for those of a dead instance
+	b.alive(ctx)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.keepAlive(ctx)
+	}()
+
+	for _, channel := range channels {
+		stream := streamKey(channel)
+		b.createGroup(ctx, stream)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.read(ctx, stream, handler)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (b *StreamBus) createGroup(ctx context.Context, stream string) {
+	err := b.rdb.XGroupCreateMkStream(ctx, stream, b.group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		b.logger.Error("failed to create consumer group", err, slog.String("stream", stream))
+	}
+}
+
+func (b *StreamBus) retain() time.Duration {
+	if b.retention <= 0 {
+		return 10 * time.Minute
+	}
+
+	return b.retention
+}
+
+func (b *StreamBus) alive(ctx context.Context) {
+	if err := b.rdb.Set(ctx, streamAliveKey(b.group), 1, b.retain()).Err(); err != nil {
+		b.logger.Error("failed to refresh stream alive key", err)
+	}
+}
+
+// keepAlive refreshes the alive key of the instance and sweeps the streams of instances that stopped doing so.
+func (b *StreamBus) keepAlive(ctx context.Context) {
+	b.sweep(ctx)
+
+	ticker := time.NewTicker(b.retain() / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if b.closed.Load() {
+			return
+		}
+
+		b.alive(ctx)
+		b.sweep(ctx)
+	}
+}
+
+func (b *StreamBus) sweep(ctx context.Context) {
+	broadcast := streamKey(broadcastChannel)
+
+	groups, err := b.rdb.XInfoGroups(ctx, broadcast).Result()
+	if err != nil {
+		// nobody subscribed yet
+		return
+	}
+
+	for _, group := range groups {
+		if group.Name == b.group {
+			continue
+		}
+
+		if n, err := b.rdb.Exists(ctx, streamAliveKey(group.Name)).Result(); err != nil || n > 0 {
+			continue
+		}
+
+		b.logger.Warn("removing streams of a dead instance", slog.String("instance", group.Name))
+
+		if err := b.remove(ctx, group.Name); err != nil {
+			b.logger.Error("failed to remove streams", err, slog.String("instance", group.Name))
+		}
+	}
+}
+
+// remove drops the group of an instance on the broadcast stream and the instance's own stream.
+func (b *StreamBus) remove(ctx context.Context, group string) error {
+	if err := b.rdb.XGroupDestroy(ctx, streamKey(broadcastChannel), group).Err(); err != nil {
+		return err
+	}
+
+	return b.rdb.Del(ctx, streamKey(group), streamAliveKey(group)).Err()
+}
+
+// Close removes the streams of the instance unless entries are still pending on them, those are left for the
+// instance to pick up again when it restarts, or for the sweep once it does not.
+func (b *StreamBus) Close(ctx context.Context) error {
+	b.closed.Store(true)
+
+	for _, stream := range []string{streamKey(b.group), streamKey(broadcastChannel)} {
+		pending, err := b.rdb.XPending(ctx, stream, b.group).Result()
+		if err != nil && !strings.HasPrefix(err.Error(), "NOGROUP") {
+			return err
+		}
+
+		if err == nil && pending.Count > 0 {
+			b.logger.Warn(
+				"keeping streams with pending entries",
+				slog.String("stream", stream),
+				slog.Int64("pending", pending.Count),
+			)
+			return nil
+		}
+	}
+
+	return b.remove(ctx, b.group)
+}
+
+func (b *StreamBus) read(ctx context.Context, stream string, handler func(event Event, ack func())) {
+	// entries delivered to us before a restart but never acknowledged come first, paging through them by ID
+	pending := true
+	offset := "0"
+
+	for ctx.Err() == nil && !b.closed.Load() {
+		id := ">"
+		if pending {
+			id = offset
+		}
+
+		args := &redis.XReadGroupArgs{
+			Group:    b.group,
+			Consumer: b.group,
+			Streams:  []string{stream, id},
+			Count:    100,
+			Block:    5 * time.Second,
+		}
+
+		res, err := b.rdb.XReadGroup(ctx, args).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") && !b.closed.Load() {
+			// swept while the instance was unreachable, it starts over from new entries
+			b.logger.Warn("consumer group gone", slog.String("stream", stream))
+			b.createGroup(ctx, stream)
+			continue
+		} else if err != nil {
+			if ctx.Err() == nil && !b.closed.Load() {
+				b.logger.Error("failed to read cluster events", err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+
+		received := 0
+		for _, s := range res {
+			for _, msg := range s.Messages {
+				received++
+				offset = msg.ID
+				b.handle(stream, msg, handler)
+			}
+		}
+
+		if pending && received == 0 {
+			pending = false
+		}
+	}
+}
+
+func (b *StreamBus) handle(stream string, msg redis.XMessage, handler func(event Event, ack func())) {
+	ack := func() {
+		if err := b.rdb.XAck(context.Background(), stream, b.group, msg.ID).Err(); err != nil {
+			b.logger.Error("failed to acknowledge cluster event", err, slog.String("entry", msg.ID))
+		}
+	}
+
+	payload, _ := msg.Values["event"].(string)
+
+	event := Event{}
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		b.logger.Error("failed to unmarshal cluster event", err)
+		ack()
+		return
+	}
+
+	handler(event, ack)
+}
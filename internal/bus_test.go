@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/ksuid"
+	"golang.org/x/exp/slog"
+)
+
+func TestStreamBus(t *testing.T) {
+	handler := slog.HandlerOptions{AddSource: true}
+	logger := slog.New(handler.NewTextHandler(os.Stdout))
+
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" {
+		redisAddr = "localhost:6379"
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
+	instanceID := ksuid.New().String()
+
+	bus, err := NewBus(logger, rdb, instanceID, Config{Bus: "streams", StreamMaxLen: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscribe := func(ack bool) (chan Event, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		events := make(chan Event, 10)
+		go bus.Subscribe(ctx, []string{instanceID}, func(event Event, done func()) {
+			if ack {
+				done()
+			}
+			events <- event
+		})
+		time.Sleep(defaultWaitTime)
+		return events, cancel
+	}
+
+	events, cancel := subscribe(false)
+	if err := bus.Publish(context.Background(), instanceID, Event{Type: EventTypeDrop, ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-events:
+		if event.ID != "a" {
+			t.Error("unexpected event")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("event not delivered")
+	}
+
+	cancel()
+
+	// the unacknowledged event is delivered again after a restart
+	events, cancel = subscribe(true)
+	defer cancel()
+
+	select {
+	case event := <-events:
+		if event.ID != "a" {
+			t.Error("unexpected redelivered event")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("pending event not redelivered")
+	}
+
+	time.Sleep(defaultWaitTime)
+	pending, err := rdb.XPending(context.Background(), streamKey(instanceID), instanceID).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pending.Count != 0 {
+		t.Error("event not acknowledged")
+	}
+
+	if err := bus.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// publishing to an instance that closed does not bring its stream back
+	if err := bus.Publish(context.Background(), instanceID, Event{Type: EventTypeDrop, ID: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ := rdb.Exists(context.Background(), streamKey(instanceID)).Result(); n != 0 {
+		t.Error("stream of a closed instance left behind")
+	}
+
+	// entries still pending when closing are kept for the instance to recover after a restart
+	ctx := context.Background()
+	pendingID := ksuid.New().String()
+
+	if err := rdb.XGroupCreateMkStream(ctx, streamKey(pendingID), pendingID, "$").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rdb.XAdd(ctx, &redis.XAddArgs{Stream: streamKey(pendingID), Values: map[string]any{"event": "{}"}}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	args := &redis.XReadGroupArgs{Group: pendingID, Consumer: pendingID, Streams: []string{streamKey(pendingID), ">"}}
+	if err := rdb.XReadGroup(ctx, args).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	pendingBus := &StreamBus{logger: logger, rdb: rdb, group: pendingID, maxLen: 100}
+	if err := pendingBus.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ := rdb.Exists(ctx, streamKey(pendingID)).Result(); n != 1 {
+		t.Error("stream with pending entries removed")
+	}
+
+	if err := rdb.Del(ctx, streamKey(pendingID)).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamBusSweep(t *testing.T) {
+	handler := slog.HandlerOptions{AddSource: true}
+	logger := slog.New(handler.NewTextHandler(os.Stdout))
+
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" {
+		redisAddr = "localhost:6379"
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
+	ctx := context.Background()
+
+	// an instance that died without closing, its alive key ran out
+	dead := ksuid.New().String()
+	for _, stream := range []string{streamKey(broadcastChannel), streamKey(dead)} {
+		if err := rdb.XGroupCreateMkStream(ctx, stream, dead, "$").Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	instanceID := ksuid.New().String()
+	bus := &StreamBus{logger: logger, rdb: rdb, group: instanceID, maxLen: 100, retention: time.Minute}
+
+	sCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go bus.Subscribe(sCtx, []string{instanceID, broadcastChannel}, func(event Event, ack func()) { ack() })
+	time.Sleep(defaultWaitTime)
+
+	groups, err := rdb.XInfoGroups(ctx, streamKey(broadcastChannel)).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, group := range groups {
+		if group.Name == dead {
+			t.Error("group of a dead instance not swept")
+		}
+	}
+
+	if n, _ := rdb.Exists(ctx, streamKey(dead)).Result(); n != 0 {
+		t.Error("stream of a dead instance not swept")
+	}
+
+	if n, _ := rdb.Exists(ctx, streamAliveKey(instanceID)).Result(); n != 1 {
+		t.Error("instance not marked alive")
+	}
+
+	if err := bus.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPubSubBus(t *testing.T) {
+	handler := slog.HandlerOptions{AddSource: true}
+	logger := slog.New(handler.NewTextHandler(os.Stdout))
+
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" {
+		redisAddr = "localhost:6379"
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
+
+	// an instance named like the broadcast channel would get every broadcast as its own events
+	if _, err := NewRedisBackend(logger, rdb, broadcastChannel, Config{}); err == nil {
+		t.Error("instance id in the reserved namespace accepted")
+	}
+
+	for _, sharded := range []bool{false, true} {
+		if sharded && rdb.SPublish(context.Background(), "probe", "").Err() != nil {
+			t.Log("sharded pub/sub not supported by the server")
+			continue
+		}
+
+		instanceID := ksuid.New().String()
+		bus := &PubSubBus{logger: logger, rdb: rdb, sharded: sharded}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		events := make(chan Event, 10)
+		go bus.Subscribe(ctx, []string{instanceID, broadcastChannel}, func(event Event, ack func()) {
+			ack()
+			events <- event
+		})
+		time.Sleep(defaultWaitTime)
+
+		for _, channel := range []string{instanceID, broadcastChannel} {
+			if err := bus.Publish(ctx, channel, Event{Type: EventTypeDrop, ID: channel}); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case event := <-events:
+				if event.ID != channel {
+					t.Errorf("unexpected event on %v", channel)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("event on %v not delivered, sharded %v", channel, sharded)
+			}
+		}
+
+		cancel()
+	}
+}
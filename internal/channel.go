@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func SubscribeHandler[T any](registry Registry, routes *Routes[T]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, route := routes.Verify(r)
+		if id == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		ctx := r.Context()
+
+		record, err := registry.Get(ctx, id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if len(record) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if record["route"] != route.Name {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if err := registry.Subscribe(ctx, route.Name, chi.URLParam(r, "name"), id); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func UnsubscribeHandler[T any](registry Registry, routes *Routes[T]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, route := routes.Verify(r)
+		if id == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if err := registry.Unsubscribe(r.Context(), route.Name, chi.URLParam(r, "name"), id); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func PublishHandler[T any](
+	state *State,
+	registry Registry,
+	bus Bus,
+	cfg Config,
+	routes *Routes[T],
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, route := routes.Verify(r)
+		if id == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		ctx := r.Context()
+		name := chi.URLParam(r, "name")
+		isBinary := r.Header.Get("Content-Type") == "application/octet-stream"
+
+		limitBody(w, r, cfg)
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(bodyStatus(err))
+			return
+		}
+
+		members, err := registry.Members(ctx, route.Name, name)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		results, err := fanOut(ctx, state, registry, bus, cfg, route.Name, members, isBinary, b)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		missing := make([]string, 0)
+		for member, result := range results {
+			if result == DeliveryNotFound {
+				missing = append(missing, member)
+			}
+		}
+
+		// members whose connection record expired are left over from instances that died without cleaning up
+		if len(missing) > 0 {
+			_ = registry.Prune(ctx, route.Name, name, missing)
+		}
+
+		if oversized(cfg, b) && cfg.OversizePolicy != OversizePolicySplit {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
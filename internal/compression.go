@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"nhooyr.io/websocket"
+)
+
+type Compression string
+
+const (
+	CompressionNoContextTakeover Compression = "no-context-takeover"
+	CompressionContextTakeover   Compression = "context-takeover"
+	CompressionDisabled          Compression = "disabled"
+)
+
+// Mode maps the setting onto the library, anything unknown keeps the library default.
+func (c Compression) Mode() websocket.CompressionMode {
+	switch c {
+	case CompressionContextTakeover:
+		return websocket.CompressionContextTakeover
+	case CompressionDisabled:
+		return websocket.CompressionDisabled
+	default:
+		return websocket.CompressionNoContextTakeover
+	}
+}
+
+// WireCounter counts the bytes that crossed the socket, after compression and including frame headers and control
+// frames. Comparing them to the payload bytes shows what compression saves.
+type WireCounter struct {
+	recv atomic.Int64
+	sent atomic.Int64
+}
+
+// Wrap hands the websocket library a response writer whose hijacked connection is counted.
+func (c *WireCounter) Wrap(w http.ResponseWriter) http.ResponseWriter {
+	return &countingResponseWriter{ResponseWriter: w, counter: c}
+}
+
+// Flush adds the bytes counted since the last flush to the connection record.
+func (c *WireCounter) Flush(ctx context.Context, registry Registry, id string) error {
+	recv, sent := c.recv.Swap(0), c.sent.Swap(0)
+	if recv == 0 && sent == 0 {
+		return nil
+	}
+
+	return registry.Increment(ctx, id, map[string]int64{"recv_wire": recv, "sent_wire": sent})
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	counter *WireCounter
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http.ResponseWriter does not implement http.Hijacker")
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	counted := &countingConn{Conn: conn, counter: w.counter}
+
+	// the reader keeps what it already buffered, the writer is fresh after a hijack
+	return counted, bufio.NewReadWriter(brw.Reader, bufio.NewWriterSize(counted, brw.Writer.Size())), nil
+}
+
+type countingConn struct {
+	net.Conn
+	counter *WireCounter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.counter.recv.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.counter.sent.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nhooyr.io/websocket"
+)
+
+func TestWireCounter(t *testing.T) {
+	ctx := context.Background()
+
+	wire := &WireCounter{}
+	received := make(chan int, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		opts := &websocket.AcceptOptions{CompressionMode: CompressionContextTakeover.Mode()}
+		conn, err := websocket.Accept(wire.Wrap(w), r, opts)
+		if err != nil {
+			return
+		}
+
+		_, b, err := conn.Read(ctx)
+		if err != nil {
+			received <- 0
+			return
+		}
+
+		received <- len(b)
+		_ = conn.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer server.Close()
+
+	opts := &websocket.DialOptions{CompressionMode: websocket.CompressionContextTakeover}
+	conn, _, err := websocket.Dial(ctx, strings.Replace(server.URL, "http", "ws", 1), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := bytes.Repeat([]byte(`{"key":"value"}`), 1000)
+	if err := conn.Write(ctx, websocket.MessageText, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := <-received; n != len(payload) {
+		t.Fatalf("expected %v payload bytes, got %v", len(payload), n)
+	}
+
+	_ = conn.Close(websocket.StatusNormalClosure, "")
+
+	if n := wire.recv.Load(); n == 0 || n >= int64(len(payload)) {
+		t.Errorf("expected fewer wire bytes than the %v payload bytes, got %v", len(payload), n)
+	}
+
+	if wire.sent.Load() == 0 {
+		t.Error("sent bytes not counted")
+	}
+}
@@ -0,0 +1,118 @@
+package internal
+
+import "time"
+
+type Config struct {
+	// Routes maps "[host]/prefix" to the downstream URL serving joins on it, like
+	// "chat.example.com/chat=https://chat.internal;/notifications=https://notify.internal". Joins no route claims go
+	// to DOWNSTREAM_URL.
+	Routes map[string]string `env:"ROUTES,delimiter=;,separator=="`
+
+	// Origins maps the domain a client joins on to the origin patterns accepted there, comma separated, like
+	// "chat.example.com=app.example.com;*.tenant.example=*.tenant.example". Domains without an entry accept their own
+	// origin and the service domains.
+	Origins map[string]string `env:"ORIGINS,delimiter=;,separator=="`
+
+	// Backend is where connection state lives, "redis" or "memory". The latter keeps everything in the process and
+	// only suits a single instance.
+	Backend string `env:"BACKEND,default=redis"`
+
+	// Bus selects how events reach other instances, either "pubsub" or "streams". Streams are capped at StreamMaxLen
+	// entries, those of an instance that went away without shutting down are removed after StreamRetention.
+	Bus             string        `env:"BUS,default=pubsub"`
+	StreamMaxLen    int64         `env:"STREAM_MAX_LEN,default=10000"`
+	StreamRetention time.Duration `env:"STREAM_RETENTION,default=10m"`
+
+	// ResumeGrace is how long a connection that dropped without a close handshake can be resumed, zero disables it.
+	ResumeGrace  time.Duration `env:"RESUME_GRACE,default=0"`
+	ResumeBuffer int64         `env:"RESUME_BUFFER,default=100"`
+
+	// PingInterval is how often sockets are pinged and their records refreshed, records of connections that were not
+	// refreshed for ConnectionTTL are considered gone. IdleTimeout closes sockets without messages in either direction,
+	// MaxLifetime makes clients reconnect and authenticate again, downstream can override it per connection. Zero
+	// disables the latter two.
+	PingInterval  time.Duration `env:"PING_INTERVAL,default=45s"`
+	ConnectionTTL time.Duration `env:"CONNECTION_TTL,default=90s"`
+	IdleTimeout   time.Duration `env:"IDLE_TIMEOUT,default=0"`
+	MaxLifetime   time.Duration `env:"MAX_LIFETIME,default=0"`
+	// DownstreamTimeout bounds each request to downstream.
+	DownstreamTimeout time.Duration `env:"DOWNSTREAM_TIMEOUT,default=30s"`
+
+	// QueueDepth and QueueBytes bound the messages waiting for each socket, zero means unbounded. QueuePolicy decides
+	// what happens to a message that does not fit, "block" waits up to QueueTimeout for room. Only writes to sockets
+	// of the instance taking the request block, events from other instances never wait and are dropped instead.
+	QueueDepth   int           `env:"QUEUE_DEPTH,default=256"`
+	QueueBytes   int           `env:"QUEUE_BYTES,default=4194304"`
+	QueuePolicy  QueuePolicy   `env:"QUEUE_POLICY,default=block"`
+	QueueTimeout time.Duration `env:"QUEUE_TIMEOUT,default=5s"`
+
+	// DownstreamAttempts is how often a client message is sent to downstream before it is dead lettered.
+	DownstreamAttempts   int           `env:"DOWNSTREAM_ATTEMPTS,default=3"`
+	DownstreamBackoff    time.Duration `env:"DOWNSTREAM_BACKOFF,default=200ms"`
+	DownstreamMaxBackoff time.Duration `env:"DOWNSTREAM_MAX_BACKOFF,default=5s"`
+	DeadLetterMax        int64         `env:"DEAD_LETTER_MAX,default=10000"`
+
+	// BreakerThreshold consecutive downstream failures open the breaker for BreakerCooldown, zero disables it. Live
+	// sockets whose messages hit an open breaker are closed with BreakerCloseCode.
+	BreakerThreshold int           `env:"BREAKER_THRESHOLD,default=5"`
+	BreakerCooldown  time.Duration `env:"BREAKER_COOLDOWN,default=30s"`
+	BreakerCloseCode int           `env:"BREAKER_CLOSE_CODE,default=1013"`
+
+	// CompressionMode is "no-context-takeover", "context-takeover" or "disabled". Messages smaller than
+	// CompressionThreshold are sent as they are, zero picks the library default.
+	CompressionMode      Compression `env:"COMPRESSION_MODE,default=no-context-takeover"`
+	CompressionThreshold int         `env:"COMPRESSION_THRESHOLD,default=0"`
+
+	// MaxFrameSize is the largest message a client may send, the socket is closed with 1009 for bigger ones.
+	// MaxBodySize bounds request bodies from downstream. Messages to clients over MaxMessageSize are split into several
+	// or rejected, depending on OversizePolicy. Zero disables a limit.
+	MaxFrameSize   int64          `env:"MAX_FRAME_SIZE,default=32768"`
+	MaxBodySize    int64          `env:"MAX_BODY_SIZE,default=1048576"`
+	MaxMessageSize int            `env:"MAX_MESSAGE_SIZE,default=0"`
+	OversizePolicy OversizePolicy `env:"OVERSIZE_POLICY,default=reject"`
+
+	// RateMessages and RateBytes are the per second rates a connection may send at, IPRateMessages and IPRateBytes
+	// apply to all connections of a client address across the cluster. What happens to a message over the limit is up
+	// to RateAction, "drop", "warn" or "close". Zero disables a limit.
+	RateMessages        float64    `env:"RATE_MESSAGES,default=0"`
+	RateBytes           float64    `env:"RATE_BYTES,default=0"`
+	IPRateMessages      int64      `env:"IP_RATE_MESSAGES,default=0"`
+	IPRateBytes         int64      `env:"IP_RATE_BYTES,default=0"`
+	RateAction          RateAction `env:"RATE_ACTION,default=drop"`
+	MaxConnectionsPerIP int64      `env:"MAX_CONNECTIONS_PER_IP,default=0"`
+	// ClientIPHeader names the header a proxy in front of the gateway puts the client address in, like Fly-Client-IP.
+	// For a list like X-Forwarded-For, TrustedProxies is how many proxies in front append to it, the address is
+	// taken that many entries from the right, everything further left is made up by the client as it pleases.
+	ClientIPHeader string `env:"CLIENT_IP_HEADER"`
+	TrustedProxies int    `env:"TRUSTED_PROXIES,default=1"`
+
+	// DrainTimeout bounds how long a shutdown waits for connections to leave, it has to stay below the kill timeout of
+	// the platform. Sockets are closed with DrainCloseCode and DrainCloseReason as the hint to reconnect, spread over
+	// DrainSpread.
+	DrainTimeout     time.Duration `env:"DRAIN_TIMEOUT,default=25s"`
+	DrainSpread      time.Duration `env:"DRAIN_SPREAD,default=0"`
+	DrainCloseCode   int           `env:"DRAIN_CLOSE_CODE,default=1012"`
+	DrainCloseReason string        `env:"DRAIN_CLOSE_REASON,default=reconnect"`
+
+	// TraceExporter is "none", "otlp" or "stdout", the latter writes to TraceFile when it is set.
+	TraceExporter    string  `env:"TRACE_EXPORTER,default=none"`
+	TraceFile        string  `env:"TRACE_FILE"`
+	TraceSampleRatio float64 `env:"TRACE_SAMPLE_RATIO,default=1"`
+}
+
+// pingInterval and connectionTTL fall back to the defaults, a Config built in code has no use for zero values there.
+func (c Config) pingInterval() time.Duration {
+	if c.PingInterval <= 0 {
+		return 45 * time.Second
+	}
+
+	return c.PingInterval
+}
+
+func (c Config) connectionTTL() time.Duration {
+	if c.ConnectionTTL <= 0 {
+		return 2 * c.pingInterval()
+	}
+
+	return c.ConnectionTTL
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type ConnectionInfo struct {
+	ID       string    `json:"id"`
+	Instance string    `json:"instance"`
+	Joined   time.Time `json:"joined"`
+	Received int64     `json:"received"`
+	Sent     int64     `json:"sent"`
+	// payload bytes before compression and bytes on the wire after it
+	ReceivedBytes int64 `json:"received_bytes"`
+	SentBytes     int64 `json:"sent_bytes"`
+	ReceivedWire  int64 `json:"received_wire"`
+	SentWire      int64 `json:"sent_wire"`
+	// messages over the size limits in either direction or over the rate limits
+	Violations  int64  `json:"violations"`
+	Meta        string `json:"meta,omitempty"`
+	Subprotocol string `json:"subprotocol,omitempty"`
+}
+
+type ConnectionList struct {
+	Cursor      uint64           `json:"cursor"`
+	Connections []ConnectionInfo `json:"connections"`
+}
+
+// InspectHandler only shows connections of the signing downstream's route, others look like they do not exist.
+func InspectHandler[T any](registry Registry, routes *Routes[T]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		signer, route := routes.Verify(r)
+		if signer == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		id := chi.URLParam(r, "id")
+
+		data, err := registry.Get(r.Context(), id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if len(data) == 0 || data["route"] != route.Name {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(connectionInfo(id, data))
+	}
+}
+
+func AliveHandler[T any](registry Registry, routes *Routes[T]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		signer, route := routes.Verify(r)
+		if signer == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		data, err := registry.Get(r.Context(), chi.URLParam(r, "id"))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if len(data) == 0 || data["route"] != route.Name {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListHandler pages through the connections of the signing downstream's route.
+func ListHandler[T any](registry Registry, routes *Routes[T]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		signer, route := routes.Verify(r)
+		if signer == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		query := r.URL.Query()
+
+		cursor := uint64(0)
+		if value := query.Get("cursor"); value != "" {
+			c, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			cursor = c
+		}
+
+		count, ok := countParam(r)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		list, err := listConnections(r.Context(), registry, cursor, count, route.Name, query.Get("instance"))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(list)
+	}
+}
+
+func listConnections(
+	ctx context.Context,
+	registry Registry,
+	cursor uint64,
+	count int64,
+	route, instanceID string,
+) (ConnectionList, error) {
+	list := ConnectionList{Connections: make([]ConnectionInfo, 0)}
+
+	ids, records, next, err := registry.List(ctx, cursor, count)
+	if err != nil {
+		return list, err
+	}
+
+	list.Cursor = next
+
+	for i, data := range records {
+		if data["route"] != route || (instanceID != "" && data["inst"] != instanceID) {
+			continue
+		}
+
+		list.Connections = append(list.Connections, connectionInfo(ids[i], data))
+	}
+
+	return list, nil
+}
+
+func connectionInfo(id string, data map[string]string) ConnectionInfo {
+	joined, _ := strconv.ParseInt(data["join"], 10, 64)
+	received, _ := strconv.ParseInt(data["recv"], 10, 64)
+	sent, _ := strconv.ParseInt(data["sent"], 10, 64)
+	receivedBytes, _ := strconv.ParseInt(data["recv_bytes"], 10, 64)
+	sentBytes, _ := strconv.ParseInt(data["sent_bytes"], 10, 64)
+	receivedWire, _ := strconv.ParseInt(data["recv_wire"], 10, 64)
+	sentWire, _ := strconv.ParseInt(data["sent_wire"], 10, 64)
+	violations, _ := strconv.ParseInt(data["violations"], 10, 64)
+
+	return ConnectionInfo{
+		ID:            id,
+		Instance:      data["inst"],
+		Joined:        time.Unix(joined, 0).UTC(),
+		Received:      received,
+		Sent:          sent,
+		ReceivedBytes: receivedBytes,
+		SentBytes:     sentBytes,
+		ReceivedWire:  receivedWire,
+		SentWire:      sentWire,
+		Violations:    violations,
+		Meta:          data["meta"],
+		Subprotocol:   data["proto"],
+	}
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+type ReplayResult struct {
+	Replayed int `json:"replayed"`
+	Failed   int `json:"failed"`
+	// Unreadable letters are kept at the end of the list, replaying them again would not help
+	Unreadable int `json:"unreadable"`
+}
+
+// DeadLettersHandler shows the dead letters of the signing downstream's route.
+func DeadLettersHandler[T any](letters DeadLetters, routes *Routes[T]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, route := routes.Verify(r)
+		if id == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		count, ok := countParam(r)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		items, err := letters.Peek(r.Context(), route.Name, count)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(items)
+	}
+}
+
+// ReplayDeadLettersHandler sends the oldest dead letters of the signing downstream's route to it again. Letters that
+// fail again are dead lettered anew at the end of the list. Only the letters listed when the replay starts are taken,
+// each at most once, so those that fail again are not retried within the same call.
+func ReplayDeadLettersHandler[T any](letters DeadLetters, routes *Routes[T]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, route := routes.Verify(r)
+		if id == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		count, ok := countParam(r)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		ctx := r.Context()
+		result := ReplayResult{}
+
+		listed, err := letters.Len(ctx, route.Name)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if count > listed {
+			count = listed
+		}
+
+		for i := int64(0); i < count; i++ {
+			letter, ok, err := letters.Pop(ctx, route.Name)
+			if err == ErrUnreadableLetter {
+				result.Unreadable++
+				continue
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			} else if !ok {
+				break
+			}
+
+			b, err := base64.RawURLEncoding.DecodeString(letter.Payload)
+			if err != nil {
+				if err := letters.Push(ctx, letter, 0); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+
+				result.Unreadable++
+				continue
+			}
+
+			session := Session{ID: letter.ID, Meta: []byte(letter.Meta), Subprotocol: letter.Subprotocol}
+			if err := route.Downstream.Message(ctx, session, letter.Binary, b); err != nil {
+				result.Failed++
+				continue
+			}
+
+			result.Replayed++
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(result)
+	}
+}
+
+func PurgeDeadLettersHandler[T any](letters DeadLetters, routes *Routes[T]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, route := routes.Verify(r)
+		if id == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if err := letters.Purge(r.Context(), route.Name); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func countParam(r *http.Request) (int64, bool) {
+	value := r.URL.Query().Get("count")
+	if value == "" {
+		return 100, true
+	}
+
+	count, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || count <= 0 {
+		return 0, false
+	}
+
+	return count, true
+}
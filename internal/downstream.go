@@ -0,0 +1,346 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Downstream is the service the gateway forwards joins, messages and leaves to.
+type Downstream[T any] struct {
+	route   string
+	url     string
+	client  http.Client
+	signer  func(r *http.Request, id string, meta *T) error
+	letters DeadLetters
+	cfg     Config
+	Breaker *Breaker
+}
+
+// Session is what downstream is told about the connection along with every message and the leave.
+type Session struct {
+	ID          string
+	Meta        []byte
+	Subprotocol string
+}
+
+type DeadLetter struct {
+	ID          string    `json:"id"`
+	Route       string    `json:"route"`
+	Meta        string    `json:"meta,omitempty"`
+	Subprotocol string    `json:"subprotocol,omitempty"`
+	Binary      bool      `json:"binary"`
+	Payload     string    `json:"payload"`
+	Error       string    `json:"error"`
+	Time        time.Time `json:"time"`
+}
+
+// StatusError is returned for responses outside the 2xx range.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("downstream responded with %v", e.Code)
+}
+
+func NewDownstream[T any](
+	route string,
+	url string,
+	signer func(r *http.Request, id string, meta *T) error,
+	letters DeadLetters,
+	cfg Config,
+) *Downstream[T] {
+	return &Downstream[T]{
+		route:   route,
+		url:     url,
+		client:  http.Client{Timeout: cfg.DownstreamTimeout},
+		signer:  signer,
+		letters: letters,
+		cfg:     cfg,
+		Breaker: NewBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+	}
+}
+
+// Join asks downstream whether the client may connect, forwarding its headers and query parameters. The
+// subprotocols the client offered are repeated in their own header, downstream may pick one of them by responding
+// with Websocket-Gateway-Subprotocol. The body then has to be a JSON object or empty, the subprotocol is added to it
+// as the meta of the session. The caller closes the response body.
+func (d *Downstream[T]) Join(ctx context.Context, r *http.Request, id string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range r.Header {
+		req.Header.Add(key, strings.Join(value, ","))
+	}
+
+	params := url.Values{}
+	for key, value := range r.URL.Query() {
+		params.Add(key, strings.Join(value, ","))
+	}
+
+	req.URL.RawQuery = params.Encode()
+
+	// the trace is the gateway's, not whatever the client claims
+	req.Header.Del("Traceparent")
+	req.Header.Del("Tracestate")
+	injectTrace(ctx, req)
+
+	if offered := subprotocols(r); len(offered) > 0 {
+		req.Header.Set("Websocket-Gateway-Subprotocols", strings.Join(offered, ","))
+	}
+
+	if err := d.signer(req, id, nil); err != nil {
+		return nil, err
+	}
+
+	if err := d.Breaker.Allow(); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	d.record(req, start, resp, err)
+
+	return resp, err
+}
+
+// Message forwards a client message, retrying failures with exponential backoff and jitter. Once the attempts are
+// used up the message goes to the dead letter list and the last error is returned.
+func (d *Downstream[T]) Message(ctx context.Context, session Session, binary bool, b []byte) error {
+	var err error
+	for attempt := 0; attempt < d.attempts(); attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				attempt = d.attempts()
+				continue
+			case <-time.After(d.backoff(attempt)):
+			}
+		}
+
+		if err = d.message(ctx, session, binary, b); err == nil || !retryable(err) {
+			break
+		}
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	letter := DeadLetter{
+		ID:          session.ID,
+		Route:       d.route,
+		Meta:        string(session.Meta),
+		Subprotocol: session.Subprotocol,
+		Binary:      binary,
+		Payload:     base64.RawURLEncoding.EncodeToString(b),
+		Error:       err.Error(),
+		Time:        time.Now().UTC(),
+	}
+
+	if dErr := d.letters.Push(context.Background(), letter, d.cfg.DeadLetterMax); dErr != nil {
+		return fmt.Errorf("%w, failed to dead letter: %v", err, dErr)
+	}
+
+	return err
+}
+
+func (d *Downstream[T]) message(ctx context.Context, session Session, binary bool, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	if err := d.session(req, session); err != nil {
+		return err
+	}
+
+	if binary {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	} else {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+
+	return d.do(req)
+}
+
+func (d *Downstream[T]) Leave(ctx context.Context, session Session) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, d.url, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := d.session(req, session); err != nil {
+		return err
+	}
+
+	return d.do(req)
+}
+
+// Domain asks downstream whether a certificate may be obtained for a custom domain, anything but a 2xx denies it.
+func (d *Downstream[T]) Domain(ctx context.Context, name string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%v/domains", d.url), nil)
+	if err != nil {
+		return err
+	}
+
+	req.URL.RawQuery = url.Values{"name": []string{name}}.Encode()
+	injectTrace(ctx, req)
+
+	if err := d.signer(req, name, nil); err != nil {
+		return err
+	}
+
+	return d.do(req)
+}
+
+func (d *Downstream[T]) session(req *http.Request, session Session) error {
+	injectTrace(req.Context(), req)
+
+	if err := d.signer(req, session.ID, nil); err != nil {
+		return err
+	}
+
+	meta, err := sessionMeta(session.Meta, session.Subprotocol)
+	if err != nil {
+		return err
+	}
+
+	if len(meta) > 0 {
+		req.Header.Set("Websocket-Gateway-Meta", string(meta))
+	}
+
+	return nil
+}
+
+// sessionMeta adds the chosen subprotocol to the meta downstream answered the join with, which has to be a JSON
+// object for that.
+func sessionMeta(meta []byte, subprotocol string) ([]byte, error) {
+	if subprotocol == "" {
+		return meta, nil
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if len(bytes.TrimSpace(meta)) > 0 {
+		if err := json.Unmarshal(meta, &fields); err != nil {
+			return nil, fmt.Errorf("meta of a session with a subprotocol is not a JSON object: %w", err)
+		}
+	}
+
+	if fields == nil {
+		return nil, errors.New("meta of a session with a subprotocol is not a JSON object")
+	}
+
+	b, err := json.Marshal(subprotocol)
+	if err != nil {
+		return nil, err
+	}
+
+	fields["subprotocol"] = b
+
+	return json.Marshal(fields)
+}
+
+func (d *Downstream[T]) do(req *http.Request) error {
+	if err := d.Breaker.Allow(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	d.record(req, start, resp, err)
+	if err != nil {
+		return err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{Code: resp.StatusCode}
+	}
+
+	return nil
+}
+
+// record feeds the metrics and the breaker, only failures that point at downstream itself count against the latter.
+func (d *Downstream[T]) record(req *http.Request, start time.Time, resp *http.Response, err error) {
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+
+	observeDownstream(d.route, req.Method, start, status)
+
+	if errors.Is(err, context.Canceled) {
+		d.Breaker.Release()
+		return
+	}
+
+	if err != nil || resp.StatusCode >= 500 {
+		d.Breaker.Failure()
+	} else {
+		d.Breaker.Success()
+	}
+}
+
+func (d *Downstream[T]) attempts() int {
+	if d.cfg.DownstreamAttempts < 1 {
+		return 1
+	}
+
+	return d.cfg.DownstreamAttempts
+}
+
+// backoff doubles the base delay for every attempt, capped at the maximum, and picks a random point below it.
+func (d *Downstream[T]) backoff(attempt int) time.Duration {
+	ceiling := d.cfg.DownstreamBackoff << (attempt - 1)
+	if ceiling <= 0 || ceiling > d.cfg.DownstreamMaxBackoff {
+		ceiling = d.cfg.DownstreamMaxBackoff
+	}
+
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// retryable is true for transport errors and responses that may succeed later, other client errors are final.
+func retryable(err error) bool {
+	if errors.Is(err, ErrBreakerOpen) {
+		return false
+	}
+
+	if sErr, ok := err.(*StatusError); ok {
+		return sErr.Code >= 500 || sErr.Code == http.StatusTooManyRequests || sErr.Code == http.StatusRequestTimeout
+	}
+
+	return true
+}
+
+func subprotocols(r *http.Request) []string {
+	offered := make([]string, 0)
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				offered = append(offered, protocol)
+			}
+		}
+	}
+
+	return offered
+}
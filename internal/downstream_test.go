@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/manualpilot/auth"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestDownstreamDeadLetters(t *testing.T) {
+	ctx := context.Background()
+
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" {
+		redisAddr = "localhost:6379"
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
+	if err := rdb.Del(ctx, deadLetterKey(DefaultRoute)).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer := auth.NewRequestSigner[any](privateKey, "Websocket-Gateway-Auth")
+	verifier := auth.NewRequestVerifier[any](publicKey, "Websocket-Gateway-Auth")
+
+	healthy := atomic.Bool{}
+	calls := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cfg := Config{DownstreamAttempts: 3, DownstreamBackoff: time.Millisecond, DownstreamMaxBackoff: 10 * time.Millisecond}
+	downstream := NewDownstream(DefaultRoute, server.URL, signer, &RedisStore{rdb: rdb}, cfg)
+
+	if err := downstream.Message(ctx, Session{ID: "a"}, false, []byte("lost")); err == nil {
+		t.Fatal("failing downstream did not return an error")
+	}
+
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %v", calls.Load())
+	}
+
+	if n := rdb.LLen(ctx, deadLetterKey(DefaultRoute)).Val(); n != 1 {
+		t.Fatal("message not dead lettered")
+	}
+
+	routes := &Routes[any]{routes: []*Route[any]{{Name: DefaultRoute, Downstream: downstream, Verifier: verifier}}}
+	replay := func() ReplayResult {
+		req := httptest.NewRequest(http.MethodPost, "/dead-letters/replay", nil)
+		if err := signer(req, "admin", nil); err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		ReplayDeadLettersHandler(&RedisStore{rdb: rdb}, routes)(rec, req)
+
+		result := ReplayResult{}
+		if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+
+		return result
+	}
+
+	// a letter that fails again goes to the end of the list, it is not taken a second time by the same replay
+	calls.Store(0)
+	if result := replay(); result.Replayed != 0 || result.Failed != 1 {
+		t.Errorf("unexpected replay result %+v", result)
+	}
+
+	if calls.Load() != 3 {
+		t.Errorf("failing letter retried within one replay, %v attempts", calls.Load())
+	}
+
+	// letters that can not be read are reported and kept
+	if err := rdb.RPush(ctx, deadLetterKey(DefaultRoute), "{").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&RedisStore{rdb: rdb}).Push(ctx, DeadLetter{ID: "b", Route: DefaultRoute, Payload: "!"}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	healthy.Store(true)
+
+	if result := replay(); result.Replayed != 1 || result.Failed != 0 || result.Unreadable != 2 {
+		t.Errorf("unexpected replay result %+v", result)
+	}
+
+	if n := rdb.LLen(ctx, deadLetterKey(DefaultRoute)).Val(); n != 2 {
+		t.Errorf("expected the 2 unreadable letters to be kept, %v listed", n)
+	}
+}
+
+func TestSessionMeta(t *testing.T) {
+	if meta, err := sessionMeta([]byte("plain"), ""); err != nil || string(meta) != "plain" {
+		t.Errorf("meta without a subprotocol changed to %s, %v", meta, err)
+	}
+
+	if meta, err := sessionMeta(nil, "chat.v2"); err != nil || string(meta) != `{"subprotocol":"chat.v2"}` {
+		t.Errorf("wrong meta %s, %v", meta, err)
+	}
+
+	meta, err := sessionMeta([]byte(`{"user":"a"}`), "chat.v2")
+	if err != nil || string(meta) != `{"subprotocol":"chat.v2","user":"a"}` {
+		t.Errorf("wrong meta %s, %v", meta, err)
+	}
+
+	for _, meta := range []string{"plain", "[1]", "null"} {
+		if _, err := sessionMeta([]byte(meta), "chat.v2"); err == nil {
+			t.Errorf("subprotocol added to %v", meta)
+		}
+	}
+}
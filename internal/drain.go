@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Drain fails the health check, turns away new joins and closes the sockets of this instance. It returns once every
+// connection has left, including the leave notification to downstream, or when ctx is done.
+func (s *State) Drain(ctx context.Context) error {
+	s.drainOnce.Do(func() { close(s.draining) })
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for s.active.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+func (s *State) Draining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// drained fires when a connection is due to be closed by the drain, after a random delay of up to spread so clients
+// do not all reconnect at once.
+func (s *State) drained(ctx context.Context, spread time.Duration) <-chan struct{} {
+	c := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.draining:
+		}
+
+		if spread > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(rand.Int63n(int64(spread)))):
+			}
+		}
+
+		close(c)
+	}()
+
+	return c
+}
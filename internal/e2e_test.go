@@ -5,6 +5,9 @@ import (
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -59,6 +62,7 @@ func TestE2E(t *testing.T) {
 	wroteTextMessage := false
 	wroteBinaryMessage := false
 	deleted := false
+	subprotocol := ""
 
 	dr := chi.NewRouter()
 	dr.Get("/.well-known/public.txt", publicKeyRoute(privateKey))
@@ -81,7 +85,12 @@ func TestE2E(t *testing.T) {
 			t.Fatal("no connection id")
 		}
 
-		redisConnectionID = fmt.Sprintf("ws:%v", connectionID)
+		redisConnectionID = connectionKey(connectionID)
+
+		if offered := r.Header.Get("Websocket-Gateway-Subprotocols"); offered != "" {
+			w.Header().Set("Websocket-Gateway-Subprotocol", strings.Split(offered, ",")[0])
+		}
+
 		w.WriteHeader(http.StatusOK)
 		return
 	})
@@ -96,6 +105,18 @@ func TestE2E(t *testing.T) {
 			t.Fatal("no connection id")
 		}
 
+		meta := struct {
+			Subprotocol string `json:"subprotocol"`
+		}{}
+
+		if value := r.Header.Get("Websocket-Gateway-Meta"); value != "" {
+			if err := json.Unmarshal([]byte(value), &meta); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		subprotocol = meta.Subprotocol
+
 		ct := r.Header.Get("Content-Type")
 
 		switch ct {
@@ -122,12 +143,17 @@ func TestE2E(t *testing.T) {
 
 	downstream := httptest.NewServer(dr)
 
-	router, err := Main(logger, ctx, instanceID, rdb, privateKey, downstream.URL, "example.com")
+	backend, err := NewRedisBackend(logger, rdb, instanceID, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gateway, err := Main(logger, ctx, instanceID, backend, privateKey, downstream.URL, []string{"example.com"}, Config{})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	server := httptest.NewServer(router)
+	server := httptest.NewServer(gateway.Router)
 	defer server.Close()
 
 	c := server.Client()
@@ -156,6 +182,7 @@ func TestE2E(t *testing.T) {
 		HTTPHeader: map[string][]string{
 			"Test": {"Test"},
 		},
+		Subprotocols: []string{"chat.v2", "chat.v1"},
 	}
 
 	// websocket -> downstream events
@@ -175,6 +202,10 @@ func TestE2E(t *testing.T) {
 		t.Error("connection not associated with instance")
 	}
 
+	if conn.Subprotocol() != "chat.v2" {
+		t.Error("subprotocol chosen by downstream not negotiated")
+	}
+
 	if err := conn.Write(ctx, websocket.MessageText, []byte("a text message")); err != nil {
 		t.Fatal("failed to write to socket")
 	}
@@ -184,6 +215,10 @@ func TestE2E(t *testing.T) {
 		t.Error("did not send text message type correctly")
 	}
 
+	if subprotocol != "chat.v2" {
+		t.Error("subprotocol not sent downstream")
+	}
+
 	if err := conn.Write(ctx, websocket.MessageBinary, []byte("a binary message")); err != nil {
 		t.Fatal("failed to write to socket")
 	}
@@ -273,4 +308,760 @@ func TestE2E(t *testing.T) {
 	if !strings.Contains(err.Error(), "EOF") {
 		t.Error("reading closed connection should have yielded EOF error")
 	}
+
+	// channel events
+
+	conn, resp, err = websocket.Dial(ctx, u, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(defaultWaitTime)
+
+	channelURL := server.URL + "/channels/test"
+
+	req, err = http.NewRequest(http.MethodPut, channelURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := signer(req, connectionID, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Error("unexpected status code")
+	}
+
+	req, err = http.NewRequest(http.MethodPost, channelURL, bytes.NewReader([]byte("to everyone")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Content-Type", "text/plain")
+	if err := signer(req, "publisher", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Error("unexpected status code")
+	}
+
+	_, b, err = conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, []byte("to everyone")) {
+		t.Error("incorrect channel message")
+	}
+
+	req, err = http.NewRequest(http.MethodPost, server.URL+"/broadcast", bytes.NewReader([]byte("to the cluster")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Websocket-Gateway-Exclude", "someone-else")
+	if err := signer(req, "publisher", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Error("unexpected status code")
+	}
+
+	_, b, err = conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, []byte("to the cluster")) {
+		t.Error("incorrect broadcast message")
+	}
+
+	bulk, err := json.Marshal(BulkWrite{
+		IDs:     []string{connectionID, "gone"},
+		Payload: base64.RawURLEncoding.EncodeToString([]byte("to some")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err = http.NewRequest(http.MethodPost, server.URL+"/bulk", bytes.NewReader(bulk))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if err := signer(req, "publisher", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make([]map[string]Delivery, 0)
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0][connectionID] != DeliveryDelivered || results[0]["gone"] != DeliveryNotFound {
+		t.Error("unexpected bulk delivery results")
+	}
+
+	_, b, err = conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, []byte("to some")) {
+		t.Error("incorrect bulk message")
+	}
+
+	// a bad payload in any write rejects the whole batch before anything is delivered
+	bulk, err = json.Marshal([]BulkWrite{
+		{IDs: []string{connectionID}, Payload: base64.RawURLEncoding.EncodeToString([]byte("never"))},
+		{IDs: []string{connectionID}, Payload: "not base64!"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err = http.NewRequest(http.MethodPost, server.URL+"/bulk", bytes.NewReader(bulk))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if err := signer(req, "publisher", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad payload answered with %v", resp.StatusCode)
+	}
+
+	// a JSON array body carries several writes just like NDJSON
+	bulk, err = json.Marshal([]BulkWrite{
+		{IDs: []string{connectionID}, Payload: base64.RawURLEncoding.EncodeToString([]byte("first"))},
+		{IDs: []string{connectionID}, Payload: base64.RawURLEncoding.EncodeToString([]byte("second"))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err = http.NewRequest(http.MethodPost, server.URL+"/bulk", bytes.NewReader(append([]byte(" \n"), bulk...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if err := signer(req, "publisher", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("JSON array body answered with %v", resp.StatusCode)
+	}
+
+	// writes to the same connection each get their own result
+	results = make([]map[string]Delivery, 0)
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 || results[0][connectionID] != DeliveryDelivered || results[1][connectionID] != DeliveryDelivered {
+		t.Errorf("unexpected bulk delivery results %v", results)
+	}
+
+	for _, expected := range []string{"first", "second"} {
+		_, b, err = conn.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(b, []byte(expected)) {
+			t.Errorf("incorrect bulk message, expected %v", expected)
+		}
+	}
+
+	req, err = http.NewRequest(http.MethodHead, server.URL+"/connections/"+connectionID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := signer(req, "inspector", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Error("connection not alive")
+	}
+
+	req, err = http.NewRequest(http.MethodGet, server.URL+"/connections?instance="+instanceID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := signer(req, "inspector", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := ConnectionList{}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+
+	listed := false
+	for _, info := range list.Connections {
+		if info.ID == connectionID && info.Instance == instanceID {
+			listed = true
+		}
+	}
+
+	if !listed {
+		t.Error("connection not listed")
+	}
+
+	if err := conn.Close(websocket.StatusNormalClosure, "bye"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(defaultWaitTime)
+	if n := rdb.SCard(ctx, channelKey(DefaultRoute, "test")).Val(); n != 0 {
+		t.Error("did not clean up channel membership")
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := slog.HandlerOptions{AddSource: true}
+	logger := slog.New(handler.NewTextHandler(os.Stdout))
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer := auth.NewRequestSigner[any](privateKey, "Websocket-Gateway-Auth")
+	verifier := auth.NewRequestVerifier[any](publicKey, "Websocket-Gateway-Auth")
+
+	joined := make(chan string, 1)
+
+	dr := chi.NewRouter()
+	dr.Get("/.well-known/public.txt", publicKeyRoute(privateKey))
+	dr.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := verifier(r)
+		joined <- id
+		w.WriteHeader(http.StatusOK)
+	})
+	dr.Delete("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	downstream := httptest.NewServer(dr)
+	defer downstream.Close()
+
+	gateway, err := Main(logger, ctx, "single", NewMemoryBackend(), privateKey, downstream.URL, []string{"example.com"}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(gateway.Router)
+	defer server.Close()
+
+	conn, _, err := websocket.Dial(ctx, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer conn.Close(websocket.StatusNormalClosure, "bye")
+
+	connectionID := <-joined
+	time.Sleep(defaultWaitTime)
+
+	publish := func(method, path string, body []byte) int {
+		req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Content-Type", "text/plain")
+		if err := signer(req, connectionID, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		//goland:noinspection GoUnhandledErrorResult
+		defer resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	if status := publish(http.MethodPut, "/channels/test", nil); status != http.StatusOK {
+		t.Fatalf("failed to subscribe, got %v", status)
+	}
+
+	if status := publish(http.MethodPost, "/channels/test", []byte("hi")); status != http.StatusOK {
+		t.Fatalf("failed to publish, got %v", status)
+	}
+
+	_, b, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "hi" {
+		t.Error("channel message not delivered")
+	}
+
+	req, err := http.NewRequest(http.MethodHead, fmt.Sprintf("%v/connections/%v", server.URL, connectionID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := signer(req, "inspector", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Error("connection not registered")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := slog.HandlerOptions{AddSource: true}
+	logger := slog.New(handler.NewTextHandler(os.Stdout))
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	left := make(chan struct{}, 1)
+
+	dr := chi.NewRouter()
+	dr.Get("/.well-known/public.txt", publicKeyRoute(privateKey))
+	dr.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	dr.Delete("/", func(w http.ResponseWriter, r *http.Request) {
+		left <- struct{}{}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	downstream := httptest.NewServer(dr)
+	defer downstream.Close()
+
+	cfg := Config{DrainCloseCode: 1012, DrainCloseReason: "reconnect"}
+	gateway, err := Main(logger, ctx, "single", NewMemoryBackend(), privateKey, downstream.URL, []string{"example.com"}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(gateway.Router)
+	defer server.Close()
+
+	conn, _, err := websocket.Dial(ctx, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(defaultWaitTime)
+
+	closed := make(chan error, 1)
+	go func() {
+		_, _, err := conn.Read(ctx)
+		closed <- err
+	}()
+
+	dCtx, dCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer dCancel()
+
+	if err := gateway.Drain(dCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-left:
+	default:
+		t.Error("leave not delivered before the drain finished")
+	}
+
+	if err := <-closed; websocket.CloseStatus(err) != websocket.StatusServiceRestart {
+		t.Errorf("expected service restart, got %v", err)
+	}
+
+	resp, err := server.Client().Get(server.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Error("health check passes while draining")
+	}
+
+	if _, _, err := websocket.Dial(ctx, server.URL, nil); err == nil {
+		t.Error("joined while draining")
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := slog.HandlerOptions{AddSource: true}
+	logger := slog.New(handler.NewTextHandler(os.Stdout))
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dr := chi.NewRouter()
+	dr.Get("/.well-known/public.txt", publicKeyRoute(privateKey))
+	dr.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WebSocket-Gateway-Max-Lifetime", r.URL.Query().Get("lifetime"))
+		w.WriteHeader(http.StatusOK)
+	})
+	dr.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	dr.Delete("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	downstream := httptest.NewServer(dr)
+	defer downstream.Close()
+
+	cfg := Config{IdleTimeout: 300 * time.Millisecond, MaxLifetime: time.Hour}
+	gateway, err := Main(logger, ctx, "single", NewMemoryBackend(), privateKey, downstream.URL, []string{"example.com"}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(gateway.Router)
+	defer server.Close()
+
+	// closed returns the reason the gateway gave for closing the socket, writing every interval until then
+	closed := func(query string, interval time.Duration) string {
+		conn, _, err := websocket.Dial(ctx, server.URL+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			for range time.Tick(interval) {
+				if err := conn.Write(ctx, websocket.MessageText, []byte("still here")); err != nil {
+					return
+				}
+			}
+		}()
+
+		_, _, err = conn.Read(ctx)
+
+		closeErr := websocket.CloseError{}
+		if !errors.As(err, &closeErr) {
+			t.Fatal(err)
+		}
+
+		return closeErr.Reason
+	}
+
+	if reason := closed("?lifetime=0", time.Hour); reason != "idle timeout" {
+		t.Errorf("idle socket closed with %v", reason)
+	}
+
+	if reason := closed("?lifetime=1", 100*time.Millisecond); reason != "lifetime exceeded" {
+		t.Errorf("socket past its lifetime closed with %v", reason)
+	}
+}
+
+func TestDomains(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := slog.HandlerOptions{AddSource: true}
+	logger := slog.New(handler.NewTextHandler(os.Stdout))
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := auth.NewRequestVerifier[any](publicKey, "Websocket-Gateway-Auth")
+
+	dr := chi.NewRouter()
+	dr.Get("/.well-known/public.txt", publicKeyRoute(privateKey))
+	dr.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	dr.Delete("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	dr.Get("/domains", func(w http.ResponseWriter, r *http.Request) {
+		if name, _ := verifier(r); name != r.URL.Query().Get("name") || name != "chat.tenant.example" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	downstream := httptest.NewServer(dr)
+	defer downstream.Close()
+
+	cfg := Config{Origins: map[string]string{"*.tenant.example": "app.tenant.example, *.tenant.example"}}
+
+	gateway, err := Main(logger, ctx, "single", NewMemoryBackend(), privateKey, downstream.URL, []string{"example.com"}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gateway.AllowDomain(ctx, "chat.tenant.example"); err != nil {
+		t.Errorf("allowed domain denied: %v", err)
+	}
+
+	if err := gateway.AllowDomain(ctx, "evil.example"); err == nil {
+		t.Error("unknown domain allowed")
+	}
+
+	server := httptest.NewServer(gateway.Router)
+	defer server.Close()
+
+	dial := func(host, origin string) error {
+		header := http.Header{}
+		header.Set("Origin", origin)
+
+		// the request goes to the test server, only the host it claims to be for changes
+		transport := roundTripper(func(req *http.Request) (*http.Response, error) {
+			req.Host = host
+			return http.DefaultTransport.RoundTrip(req)
+		})
+
+		opts := &websocket.DialOptions{HTTPHeader: header, HTTPClient: &http.Client{Transport: transport}}
+		conn, _, err := websocket.Dial(ctx, server.URL, opts)
+		if err != nil {
+			return err
+		}
+
+		return conn.Close(websocket.StatusNormalClosure, "bye")
+	}
+
+	if err := dial("chat.tenant.example", "https://app.tenant.example"); err != nil {
+		t.Errorf("origin of the tenant rejected: %v", err)
+	}
+
+	if err := dial("chat.tenant.example", "https://example.com"); err == nil {
+		t.Error("service domain accepted on a tenant domain with its own origins")
+	}
+
+	if err := dial("example.com", "https://example.com"); err != nil {
+		t.Errorf("service domain rejected: %v", err)
+	}
+
+	if err := dial("example.com", "https://app.tenant.example"); err == nil {
+		t.Error("tenant origin accepted on the service domain")
+	}
+}
+
+type roundTripper func(req *http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestResumeJoin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := slog.HandlerOptions{AddSource: true}
+	logger := slog.New(handler.NewTextHandler(os.Stdout))
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaves := make(chan struct{}, 10)
+
+	dr := chi.NewRouter()
+	dr.Get("/.well-known/public.txt", publicKeyRoute(privateKey))
+	dr.Delete("/", func(w http.ResponseWriter, r *http.Request) {
+		leaves <- struct{}{}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	downstream := httptest.NewServer(dr)
+	defer downstream.Close()
+
+	backend := NewMemoryBackend()
+	cfg := Config{ResumeGrace: time.Minute, ResumeBuffer: 10}
+
+	gateway, err := Main(logger, ctx, "single", backend, privateKey, downstream.URL, []string{"example.com"}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(gateway.Router)
+	defer server.Close()
+
+	// a connection that dropped without a close handshake, with an event waiting for it
+	id := ksuid.New().String()
+	secret, err := newResumeSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := map[string]string{"inst": "other", "resume": secret, "route": DefaultRoute, "join": "0"}
+	if err := backend.Registry.Register(ctx, id, data, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backend.Registry.Detach(ctx, id, cfg.ResumeGrace); err != nil {
+		t.Fatal(err)
+	}
+
+	event := Event{Type: EventTypeWrite, ID: id, Payload: base64.RawURLEncoding.EncodeToString([]byte("missed"))}
+	if _, err := backend.Registry.Buffer(ctx, id, event, cfg.ResumeBuffer, cfg.ResumeGrace); err != nil {
+		t.Fatal(err)
+	}
+
+	u := fmt.Sprintf("%v?resume=%v", server.URL, resumeToken(id, secret))
+
+	// a request that does not upgrade leaves the session waiting
+	resp, err := server.Client().Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	resp.Body.Close()
+
+	if record, _ := backend.Registry.Get(ctx, id); record["inst"] != "" {
+		t.Fatal("failed upgrade claimed the session")
+	}
+
+	conn, _, err := websocket.Dial(ctx, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer conn.Close(websocket.StatusNormalClosure, "bye")
+
+	_, b, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, []byte("missed")) {
+		t.Error("buffered event not replayed")
+	}
+
+	if record, _ := backend.Registry.Get(ctx, id); record["inst"] != "single" {
+		t.Error("session not claimed by the instance")
+	}
+
+	// dropping a detached session tells downstream it left, the grace timer will find nothing to expire
+	dropped := ksuid.New().String()
+	data = map[string]string{"inst": "other", "resume": secret, "route": DefaultRoute, "join": "0"}
+	if err := backend.Registry.Register(ctx, dropped, data, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backend.Registry.Detach(ctx, dropped, cfg.ResumeGrace); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer := auth.NewRequestSigner[any](privateKey, "Websocket-Gateway-Auth")
+	if err := signer(req, dropped, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("drop of a detached session answered with %v", resp.StatusCode)
+	}
+
+	select {
+	case <-leaves:
+	case <-time.After(5 * time.Second):
+		t.Error("downstream not told about the dropped session")
+	}
+
+	if record, _ := backend.Registry.Get(ctx, dropped); len(record) != 0 {
+		t.Error("dropped session still registered")
+	}
 }
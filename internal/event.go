@@ -1,190 +1,534 @@
 package internal
 
 import (
+	"bufio"
 	"context"
 	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"unicode"
 
-	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/slog"
 )
 
-func DropHandler[T any](state *State, rdb *redis.Client, verifier func(r *http.Request) (string, *T)) http.HandlerFunc {
+func DropHandler[T any](state *State, logger *slog.Logger, registry Registry, bus Bus, routes *Routes[T]) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		id, _ := verifier(r)
+		id, route := routes.Verify(r)
 		if id == "" {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		rid := fmt.Sprintf("ws:%v", id)
+		switch deliver(state, id, route.Name, Message{Drop: true}, false) {
+		case DeliveryNotFound:
+		case DeliveryForbidden:
+			w.WriteHeader(http.StatusForbidden)
+			return
+		default:
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
 		ctx := r.Context()
 
-		state.Lock.RLock()
-		defer state.Lock.RUnlock()
+		data, err := registry.Get(ctx, id)
+		if err != nil || len(data) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 
-		connection, ok := state.Connections[id]
-		if !ok {
-			instanceID, err := rdb.HGet(ctx, rid, "inst").Result()
+		if data["route"] != route.Name {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		instanceID := data["inst"]
+
+		// a detached connection has no instance to tell, it just must not be resumed anymore
+		if instanceID == "" {
+			expired, err := registry.Expire(ctx, id, data["left"])
 			if err != nil {
-				w.WriteHeader(http.StatusNotFound)
+				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
 
-			event := Event{
-				Type: EventTypeDrop,
-				ID:   id,
-			}
-
-			bEvent, err := json.Marshal(event)
-			if err != nil {
+			// resumed or detached again in the meantime, the drop can be retried against the new state
+			if !expired {
+				w.WriteHeader(http.StatusConflict)
+				return
 			}
 
-			if err := rdb.Publish(ctx, instanceID, string(bEvent)).Err(); err != nil {
+			if err := registry.LeaveChannels(ctx, id); err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
 
-			w.WriteHeader(http.StatusCreated)
+			// the grace timer finds nothing left to expire, so the leave is sent from here like for a live socket
+			session := Session{ID: id, Meta: []byte(data["meta"]), Subprotocol: data["proto"]}
+			go func() {
+				if err := route.Downstream.Leave(context.Background(), session); err != nil {
+					logger.Error("failed to notify downstream of leave", err, slog.String("id", id))
+				}
+			}()
+
+			w.WriteHeader(http.StatusOK)
 			return
 		}
 
-		connection <- Message{
-			Drop: true,
+		event := Event{
+			Type: EventTypeDrop,
+			ID:   id,
 		}
+
+		if err := bus.Publish(ctx, instanceID, event); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
 	}
 }
 
 func WriteHandler[T any](
 	state *State,
-	rdb *redis.Client,
-	verifier func(r *http.Request) (string, *T),
+	registry Registry,
+	bus Bus,
+	cfg Config,
+	routes *Routes[T],
 ) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		id, _ := verifier(r)
+		id, route := routes.Verify(r)
 		if id == "" {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		rid := fmt.Sprintf("ws:%v", id)
-		ctx := r.Context()
+		// downstream's trace continues on whichever instance owns the connection
+		ctx, span := tracer.Start(
+			extractTrace(r),
+			"write",
+			trace.WithSpanKind(trace.SpanKindServer),
+			connectionAttributes(id, route.Name),
+		)
+		defer span.End()
+
 		isBinary := r.Header.Get("Content-Type") == "application/octet-stream"
 
+		limitBody(w, r, cfg)
 		b, err := io.ReadAll(r.Body)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			w.WriteHeader(bodyStatus(err))
+			return
+		}
+
+		results, err := fanOut(ctx, state, registry, bus, cfg, route.Name, []string{id}, isBinary, b)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		span.SetAttributes(attribute.String("wsg.delivery", string(results[id])))
+		w.WriteHeader(results[id].Status())
+	}
+}
+
+// BulkWriteHandler answers with an array of results aligned with the writes, each mapping the targets of its write to
+// the outcome.
+func BulkWriteHandler[T any](
+	state *State,
+	logger *slog.Logger,
+	registry Registry,
+	bus Bus,
+	cfg Config,
+	routes *Routes[T],
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, route := routes.Verify(r)
+		if id == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		ctx := r.Context()
+
+		limitBody(w, r, cfg)
+
+		writes, err := decodeBulk(r.Body)
+		if err != nil {
+			w.WriteHeader(bodyStatus(err))
 			return
 		}
 
-		state.Lock.RLock()
-		defer state.Lock.RUnlock()
+		if len(writes) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
-		connection, ok := state.Connections[id]
-		if !ok {
-			instanceID, err := rdb.Get(ctx, rid).Result()
+		// nothing is delivered unless every write can be
+		payloads := make([][]byte, len(writes))
+		for i, write := range writes {
+			b, err := base64.RawURLEncoding.DecodeString(write.Payload)
 			if err != nil {
-				w.WriteHeader(http.StatusNotFound)
+				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
 
-			event := Event{
-				Type:    EventTypeWrite,
-				ID:      id,
-				Binary:  isBinary,
-				Payload: base64.RawURLEncoding.EncodeToString(b),
-			}
+			payloads[i] = b
+		}
 
-			bEvent, err := json.Marshal(event)
+		// one result per write, the same connection may be the target of several
+		results := make([]map[string]Delivery, len(writes))
+		for i, write := range writes {
+			res, err := fanOut(ctx, state, registry, bus, cfg, route.Name, write.IDs, write.Binary, payloads[i])
 			if err != nil {
-			}
+				logger.Error("failed to fan out bulk write", err, slog.String("route", route.Name))
 
-			if err := rdb.Publish(ctx, instanceID, string(bEvent)).Err(); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+				res = make(map[string]Delivery, len(write.IDs))
+				for _, target := range write.IDs {
+					res[target] = DeliveryFailed
+				}
 			}
 
-			w.WriteHeader(http.StatusCreated)
-			return
-		}
-
-		connection <- Message{
-			Binary: isBinary,
-			Buffer: b,
+			results[i] = res
 		}
 
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		return
+		_ = json.NewEncoder(w).Encode(results)
 	}
 }
 
-func SubscribeEvents(ctx context.Context, logger *slog.Logger, state *State, rdb *redis.Client, instanceID string) {
-	sub := rdb.Subscribe(ctx, instanceID)
-	ch := sub.Channel()
+// decodeBulk reads a JSON array of writes, or NDJSON with one write per line, a single JSON object being the
+// shortest case of the latter.
+func decodeBulk(body io.Reader) ([]BulkWrite, error) {
+	reader := bufio.NewReader(body)
+
+	first := byte(' ')
+	for unicode.IsSpace(rune(first)) {
+		c, err := reader.ReadByte()
+		if err == io.EOF {
+			return []BulkWrite{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		first = c
+	}
+
+	_ = reader.UnreadByte()
+
+	writes := make([]BulkWrite, 0)
+	decoder := json.NewDecoder(reader)
+
+	if first == '[' {
+		if err := decoder.Decode(&writes); err != nil {
+			return nil, err
+		}
+
+		return writes, nil
+	}
 
 	for {
-		select {
-		case <-ctx.Done():
-			_ = sub.Close()
+		write := BulkWrite{}
+		if err := decoder.Decode(&write); err == io.EOF {
+			return writes, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		writes = append(writes, write)
+	}
+}
+
+// BroadcastHandler reaches every connection of the signing downstream's route across the cluster.
+func BroadcastHandler[T any](bus Bus, cfg Config, routes *Routes[T]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, route := routes.Verify(r)
+		if id == "" {
+			w.WriteHeader(http.StatusUnauthorized)
 			return
-		case msg := <-ch:
-			b, err := base64.RawURLEncoding.DecodeString(msg.Payload)
+		}
+
+		ctx := r.Context()
+		isBinary := r.Header.Get("Content-Type") == "application/octet-stream"
+
+		limitBody(w, r, cfg)
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(bodyStatus(err))
+			return
+		}
+
+		// a broadcast has no single connection to count the violation against
+		if oversized(cfg, b) && cfg.OversizePolicy != OversizePolicySplit {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		exclude := make([]string, 0)
+		for _, value := range r.Header.Values("Websocket-Gateway-Exclude") {
+			for _, excluded := range strings.Split(value, ",") {
+				if excluded = strings.TrimSpace(excluded); excluded != "" {
+					exclude = append(exclude, excluded)
+				}
+			}
+		}
+
+		event := Event{
+			Type:    EventTypeBroadcast,
+			Route:   route.Name,
+			Exclude: exclude,
+			Binary:  isBinary,
+			Payload: base64.RawURLEncoding.EncodeToString(b),
+		}
+
+		if err := bus.Publish(ctx, broadcastChannel, event); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func SubscribeEvents(ctx context.Context, logger *slog.Logger, state *State, bus Bus, instanceID string) {
+	bus.Subscribe(ctx, []string{instanceID, broadcastChannel}, func(event Event, ack func()) {
+		switch event.Type {
+		case EventTypeWrite:
+			b, err := base64.RawURLEncoding.DecodeString(event.Payload)
 			if err != nil {
-				logger.Error("failed to decode cluster event", err)
-				continue
+				logger.Warn("failed to decode payload", slog.String("connection", event.ID))
+				ack()
+				return
+			}
+
+			_, span := tracer.Start(eventContext(ctx, event), "deliver", trace.WithSpanKind(trace.SpanKindConsumer))
+			defer span.End()
+
+			// acknowledge once every target has either written the message or turned out to be gone
+			targets := event.Targets()
+			remaining := int32(len(targets))
+			written := func(err error) {
+				if (err == nil || err == ErrEvicted) && atomic.AddInt32(&remaining, -1) == 0 {
+					ack()
+				}
+			}
+
+			if len(targets) == 0 {
+				ack()
+			}
+
+			for _, id := range targets {
+				// one slow socket must not hold up the events of all others, a full queue refuses right away. Messages
+				// the queue refused are as good as handled, there is nothing a redelivery would change
+				msg := Message{Binary: event.Binary, Buffer: b, Written: written}
+				switch deliver(state, id, "", msg, false) {
+				case DeliveryDelivered:
+				case DeliveryNotFound:
+					logger.Warn("no such connection", slog.String("connection", id))
+					written(nil)
+				default:
+					logger.Warn("dropped cluster message", slog.String("connection", id))
+					written(nil)
+				}
+			}
+		case EventTypeBroadcast:
+			b, err := base64.RawURLEncoding.DecodeString(event.Payload)
+			if err != nil {
+				logger.Warn("failed to decode broadcast payload")
+				ack()
+				return
+			}
+
+			broadcast(state, event.Route, Message{Binary: event.Binary, Buffer: b}, event.Exclude)
+			ack()
+		case EventTypeDrop:
+			if deliver(state, event.ID, "", Message{Drop: true}, false) == DeliveryNotFound {
+				logger.Warn("no such connection", slog.String("connection", event.ID))
+			}
+			ack()
+		default:
+			logger.Warn("unknown event type", slog.String("event", string(event.Type)))
+			ack()
+		}
+	})
+}
+
+// fanOut delivers a message to connections owned by this instance directly and forwards one event to each other
+// instance that owns the remaining connections. Messages for detached connections are buffered until they resume.
+// Connections that do not belong to the route are left alone. Oversized messages are rejected here unless they are
+// to be split when written.
+func fanOut(
+	ctx context.Context,
+	state *State,
+	registry Registry,
+	bus Bus,
+	cfg Config,
+	route string,
+	ids []string,
+	binary bool,
+	b []byte,
+) (map[string]Delivery, error) {
+	results := make(map[string]Delivery, len(ids))
+
+	if oversized(cfg, b) && cfg.OversizePolicy != OversizePolicySplit {
+		for _, id := range ids {
+			results[id] = DeliveryTooLarge
+		}
+
+		if len(ids) > 0 {
+			if err := violation(ctx, registry, route, ids...); err != nil {
+				return nil, err
 			}
+		}
+
+		return results, nil
+	}
+
+	remote := make([]string, 0)
+	for _, id := range ids {
+		if _, ok := results[id]; ok {
+			continue
+		}
+
+		results[id] = deliver(state, id, route, Message{Binary: binary, Buffer: b}, true)
+		if results[id] == DeliveryNotFound {
+			remote = append(remote, id)
+		}
+	}
 
-			event := Event{}
-			if err := json.Unmarshal(b, &event); err != nil {
-				logger.Error("failed to unmarshal cluster event", err)
+	if len(remote) == 0 {
+		return results, nil
+	}
+
+	records, err := registry.GetMany(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	carrier := traceCarrier(ctx)
+	instances := make(map[string][]string)
+	for i, data := range records {
+		id := remote[i]
+
+		if len(data) == 0 {
+			continue
+		}
+
+		if route != "" && data["route"] != route {
+			results[id] = DeliveryForbidden
+			continue
+		}
+
+		instanceID := data["inst"]
+
+		if instanceID == "" && cfg.ResumeBuffer > 0 {
+			event := Event{
+				Type:    EventTypeWrite,
+				ID:      id,
+				Binary:  binary,
+				Payload: payload,
+				Trace:   carrier,
+			}
+
+			// the connection may have been resumed in the meantime, in which case the owner is returned
+			instanceID, err = registry.Buffer(ctx, id, event, cfg.ResumeBuffer, cfg.ResumeGrace)
+			if err == ErrNotFound {
 				continue
+			} else if err != nil {
+				return nil, err
 			}
 
-			switch event.Type {
-			case EventTypeWrite:
-				func() {
-					b, err := base64.RawURLEncoding.DecodeString(event.Payload)
-					if err != nil {
-						slog.Warn("failed to decode payload", slog.String("connection", event.ID))
-						return
-					}
-
-					state.Lock.RLock()
-					defer state.Lock.RUnlock()
-
-					connection, ok := state.Connections[event.ID]
-					if !ok {
-						slog.Warn("no such connection", slog.String("connection", event.ID))
-						return
-					}
-
-					connection <- Message{
-						Binary: event.Binary,
-						Buffer: b,
-					}
-				}()
-			case EventTypeDrop:
-				func() {
-					state.Lock.RLock()
-					defer state.Lock.RUnlock()
-
-					connection, ok := state.Connections[event.ID]
-					if !ok {
-						slog.Warn("no such connection", slog.String("connection", event.ID))
-						return
-					}
-
-					connection <- Message{
-						Drop: true,
-					}
-				}()
-			default:
-				logger.Warn("unknown event type", slog.String("event", string(event.Type)))
+			if instanceID == "" {
+				results[id] = DeliveryBuffered
 				continue
 			}
 		}
+
+		if instanceID != "" {
+			instances[instanceID] = append(instances[instanceID], id)
+		}
+	}
+
+	for instanceID, targets := range instances {
+		event := Event{
+			Type:    EventTypeWrite,
+			IDs:     targets,
+			Binary:  binary,
+			Payload: payload,
+			Trace:   carrier,
+		}
+
+		if err := bus.Publish(ctx, instanceID, event); err != nil {
+			return nil, err
+		}
+
+		for _, id := range targets {
+			results[id] = DeliveryForwarded
+		}
+	}
+
+	return results, nil
+}
+
+func broadcast(state *State, route string, msg Message, exclude []string) {
+	excluded := make(map[string]struct{}, len(exclude))
+	for _, id := range exclude {
+		excluded[id] = struct{}{}
+	}
+
+	state.Lock.RLock()
+	connections := make([]*Connection, 0, len(state.Connections))
+	for id, connection := range state.Connections {
+		if _, ok := excluded[id]; !ok && (route == "" || connection.Route == route) {
+			connections = append(connections, connection)
+		}
+	}
+	state.Lock.RUnlock()
+
+	// broadcasts arrive over the bus, a socket with a full queue misses out rather than holding up the others
+	for _, connection := range connections {
+		_ = connection.Offer(msg)
+	}
+}
+
+// deliver queues a message for a connection of this instance. The lock is only held for the lookup, so a full queue
+// that blocks the caller does not hold up joins and leaves. Without wait a full queue refuses the message right away
+// whatever the policy. An empty route skips the ownership check.
+func deliver(state *State, id, route string, msg Message, wait bool) Delivery {
+	state.Lock.RLock()
+	connection, ok := state.Connections[id]
+	state.Lock.RUnlock()
+
+	if !ok {
+		return DeliveryNotFound
+	}
+
+	if route != "" && connection.Route != route {
+		return DeliveryForbidden
+	}
+
+	push := connection.Offer
+	if wait {
+		push = connection.Push
+	}
+
+	switch push(msg) {
+	case nil:
+		return DeliveryDelivered
+	case ErrQueueFull:
+		return DeliveryDropped
+	case ErrQueueTimeout:
+		return DeliveryTimeout
+	case ErrSlowConsumer:
+		return DeliveryDisconnected
+	default:
+		return DeliveryNotFound
 	}
 }
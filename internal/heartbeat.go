@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Activity remembers when a socket last carried a message in either direction, pings do not count.
+type Activity struct {
+	last atomic.Int64
+}
+
+func NewActivity() *Activity {
+	a := &Activity{}
+	a.Touch()
+	return a
+}
+
+func (a *Activity) Touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+// Since is how long the socket has been idle.
+func (a *Activity) Since() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+// parseLifetime reads the lifetime downstream picked for a connection in seconds, zero lifts the limit.
+func parseLifetime(value string) (time.Duration, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	} else if seconds < 0 {
+		return 0, strconv.ErrRange
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// recordLifetime returns when a connection joined and how long it may live, from its record.
+func recordLifetime(data map[string]string) (time.Time, time.Duration) {
+	join, _ := strconv.ParseInt(data["join"], 10, 64)
+	lifetime, _ := strconv.ParseInt(data["lifetime"], 10, 64)
+	return time.Unix(join, 0), time.Duration(lifetime) * time.Second
+}
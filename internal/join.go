@@ -1,18 +1,22 @@
 package internal
 
 import (
-	"bytes"
 	"context"
-	"fmt"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
 	"io"
+	"net"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/redis/go-redis/v9"
 	"github.com/segmentio/ksuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slices"
 	"golang.org/x/exp/slog"
 
 	"nhooyr.io/websocket"
@@ -21,177 +25,432 @@ import (
 func JoinRoute[T any](
 	state *State,
 	logger *slog.Logger,
-	rdb *redis.Client,
-	signer func(r *http.Request, id string, meta *T) error,
-	instanceID, downstream, serviceDomain string,
+	registry Registry,
+	limits Limits,
+	routes *Routes[T],
+	instanceID string,
+	serviceDomains []string,
+	cfg Config,
 ) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx, cancel := context.WithCancel(r.Context())
 		defer cancel()
 
-		now := time.Now()
+		// counted before the check, so a drain that starts in between still waits for this join
+		state.active.Add(1)
+		defer state.active.Add(-1)
 
-		kid, err := ksuid.NewRandom()
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		if state.Draining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
 
-		id := kid.String()
-		rid := fmt.Sprintf("ws:%v", id)
-		log := logger.With(slog.String("id", id))
-		hc := http.Client{Timeout: 30 * time.Second}
+		now := time.Now()
+		ip := clientIP(r, cfg)
 
-		req, err := http.NewRequest(http.MethodGet, downstream, nil)
+		// the join span covers the downstream call and the upgrade, ending it twice is harmless
+		joinCtx, joinSpan := tracer.Start(ctx, "join", trace.WithNewRoot(), trace.WithSpanKind(trace.SpanKindServer))
+		defer joinSpan.End()
+
+		release, ok, err := acquireConnection(ctx, limits, cfg, ip)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
-		}
-
-		if err := signer(r, id, nil); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		} else if !ok {
+			w.WriteHeader(http.StatusTooManyRequests)
 			return
 		}
 
-		for key, value := range r.Header {
-			req.Header.Add(key, strings.Join(value, ","))
-		}
+		defer release()
+
+		id := ""
+		var route *Route[T]
+		meta := []byte(nil)
+		subprotocol := ""
+		compression := cfg.CompressionMode
+		secret := ""
+		joined, lifetime := now, cfg.MaxLifetime
+		replay := []Event(nil)
+		resumed := false
+
+		if token := resumeTokenFrom(r); token != "" {
+			rid, rSecret, ok := parseResumeToken(token)
+			if !ok || cfg.ResumeGrace <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
 
-		params := url.Values{}
-		for key, value := range r.URL.Query() {
-			params.Add(key, strings.Join(value, ","))
-		}
+			// only looked at for now, the session is claimed once the socket is up so a failed upgrade leaves it be
+			data, err := registry.Get(ctx, rid)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 
-		req.URL.RawQuery = params.Encode()
+			if data["inst"] != "" || subtle.ConstantTimeCompare([]byte(data["resume"]), []byte(rSecret)) != 1 {
+				w.WriteHeader(http.StatusGone)
+				return
+			}
 
-		resp, err := hc.Do(req)
-		if err != nil {
-			w.WriteHeader(http.StatusBadGateway)
-			return
-		}
+			// resuming does not restart the lifetime
+			joined, lifetime = recordLifetime(data)
 
-		// TODO: could we close this earlier?
-		//goland:noinspection GoUnhandledErrorResult
-		defer resp.Body.Close()
+			subprotocol = data["proto"]
+			if mode := data["compression"]; mode != "" {
+				compression = Compression(mode)
+			}
 
-		meta, err := io.ReadAll(resp.Body)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			// the route may have been removed from the configuration since the connection joined
+			if route = routes.Get(data["route"]); route == nil {
+				w.WriteHeader(http.StatusGone)
+				return
+			}
+
+			id, meta, secret, resumed = rid, []byte(data["meta"]), rSecret, true
+		} else {
+			if route = routes.Match(r); route == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			kid, err := ksuid.NewRandom()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			id = kid.String()
+
+			resp, err := route.Downstream.Join(joinCtx, r, id)
+			if err != nil {
+				joinSpan.RecordError(err)
+			}
+
+			if errors.Is(err, ErrBreakerOpen) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+
+			//goland:noinspection GoUnhandledErrorResult
+			defer resp.Body.Close()
+
+			meta, err = io.ReadAll(resp.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+				w.WriteHeader(resp.StatusCode)
+				return
+			}
+
+			// downstream may only pick one of the subprotocols the client offered
+			subprotocol = resp.Header.Get("WebSocket-Gateway-Subprotocol")
+			if subprotocol != "" && !slices.Contains(subprotocols(r), subprotocol) {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+
+			// the subprotocol travels in the meta, which it can only be added to when that is a JSON object
+			if _, err := sessionMeta(meta, subprotocol); err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+
+			// downstream can only turn compression off, clients that do not offer it never get it anyway
+			if Compression(resp.Header.Get("WebSocket-Gateway-Compression")) == CompressionDisabled {
+				compression = CompressionDisabled
+			}
+
+			if value := resp.Header.Get("WebSocket-Gateway-Max-Lifetime"); value != "" {
+				if lifetime, err = parseLifetime(value); err != nil {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+			}
+
+			overrideID := resp.Header.Get("WebSocket-Gateway-Override-ID")
+			if overrideID != "" {
+				id = overrideID
+			}
+
+			if cfg.ResumeGrace > 0 {
+				if secret, err = newResumeSecret(); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+			}
 		}
 
-		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-			w.WriteHeader(resp.StatusCode)
-			return
+		downstream := route.Downstream
+		session := Session{ID: id, Meta: meta, Subprotocol: subprotocol}
+		log := logger.With(slog.String("id", id), slog.String("route", route.Name))
+
+		opts := &websocket.AcceptOptions{
+			OriginPatterns:       originPatterns(cfg, serviceDomains, r.Host),
+			CompressionMode:      compression.Mode(),
+			CompressionThreshold: cfg.CompressionThreshold,
 		}
 
-		overrideID := resp.Header.Get("WebSocket-Gateway-Override-ID")
-		if overrideID != "" {
-			id = overrideID
+		if subprotocol != "" {
+			opts.Subprotocols = []string{subprotocol}
 		}
 
-		opts := &websocket.AcceptOptions{
-			OriginPatterns: []string{serviceDomain},
+		if secret != "" {
+			w.Header().Set("Websocket-Gateway-Resume-Token", resumeToken(id, secret))
 		}
 
-		conn, err := websocket.Accept(w, r, opts)
+		wire := &WireCounter{}
+		conn, err := websocket.Accept(wire.Wrap(w), r, opts)
 		if err != nil {
 			return
 		}
 
-		msgChan := make(chan Message)
+		// another join may have resumed the session since it was looked at
+		if resumed {
+			events, ok, err := registry.Claim(ctx, id, secret, instanceID, cfg.connectionTTL())
+			if err != nil {
+				_ = conn.Close(websocket.StatusInternalError, "")
+				return
+			} else if !ok {
+				_ = conn.Close(websocket.StatusPolicyViolation, "resume failed")
+				return
+			}
+
+			replay = events
+		}
+
+		joinSpan.SetAttributes(attribute.String("wsg.connection", id), attribute.String("wsg.route", route.Name))
+		joinSpan.End()
+
+		metricJoinDuration.WithLabelValues(route.Name).Observe(time.Since(now).Seconds())
+		metricJoins.WithLabelValues(route.Name).Inc()
+		metricConnections.WithLabelValues(route.Name).Inc()
+
+		defer func() {
+			metricConnections.WithLabelValues(route.Name).Dec()
+			metricLeaves.WithLabelValues(route.Name).Inc()
+		}()
+
+		readLimit(conn, cfg)
+		limiter := NewLimiter(limits, cfg, ip)
+		queue := NewQueue(cfg)
 
 		state.Lock.Lock()
-		state.Connections[id] = msgChan
+		state.Connections[id] = &Connection{Queue: queue, Route: route.Name, Subprotocol: subprotocol}
 		state.Lock.Unlock()
 
-		data := map[string]string{
-			"inst": instanceID,
-			"join": strconv.Itoa(int(now.Unix())),
-			"recv": "0",
-			"sent": "0",
+		// the response belongs to the socket by now, failures can only be told by closing it
+		abort := func(err error) {
+			log.Error("failed to register connection", err)
+
+			state.Lock.Lock()
+			delete(state.Connections, id)
+			state.Lock.Unlock()
+			queue.Close()
+
+			_ = conn.Close(websocket.StatusInternalError, "")
 		}
 
-		if err := rdb.HSet(ctx, rid, data).Err(); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		// a resumed connection already has its record, only the expiry needs to be extended
+		if resumed {
+			if err := registry.Refresh(ctx, id, cfg.connectionTTL()); err != nil {
+				abort(err)
+				return
+			}
+		} else {
+			data := map[string]string{
+				"inst":       instanceID,
+				"join":       strconv.Itoa(int(now.Unix())),
+				"recv":       "0",
+				"sent":       "0",
+				"recv_bytes": "0",
+				"sent_bytes": "0",
+				"recv_wire":  "0",
+				"sent_wire":  "0",
+				"violations": "0",
+				"meta":       string(meta),
+				"route":      route.Name,
+			}
+
+			if secret != "" {
+				data["resume"] = secret
+			}
+
+			if subprotocol != "" {
+				data["proto"] = subprotocol
+			}
+
+			if compression != "" {
+				data["compression"] = string(compression)
+			}
+
+			if lifetime > 0 {
+				data["lifetime"] = strconv.Itoa(int(lifetime.Seconds()))
+			}
+
+			if err := registry.Register(ctx, id, data, cfg.connectionTTL()); err != nil {
+				abort(err)
+				return
+			}
 		}
 
-		if err := rdb.Expire(ctx, rid, 90*time.Second).Err(); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		leave := func() {
+			if err := registry.LeaveChannels(context.Background(), id); err != nil {
+				log.Error("failed to leave channels", err)
+			}
+
+			if err := registry.Delete(context.Background(), id); err != nil {
+				log.Error("failed to cleanup", err)
+			}
+
+			if err := downstream.Leave(context.Background(), session); err != nil {
+				log.Error("failed to notify downstream of leave", err)
+			}
 		}
 
+		// connections that went away without a close handshake can be resumed within the grace window
+		resumable := atomic.Bool{}
+		resumable.Store(secret != "")
+
 		defer func() {
 			state.Lock.Lock()
-			defer state.Lock.Unlock()
 			delete(state.Connections, id)
-			close(msgChan)
-			if err := rdb.Del(context.Background(), rid).Err(); err != nil {
-				log.Error("failed to cleanup", err)
+			state.Lock.Unlock()
+			queue.Close()
+
+			if !resumable.Load() {
+				leave()
+				return
 			}
 
-			req, err := http.NewRequest(http.MethodDelete, downstream, nil)
+			if err := wire.Flush(context.Background(), registry, id); err != nil {
+				log.Error("failed to update wire stats", err)
+			}
+
+			left, err := registry.Detach(context.Background(), id, cfg.ResumeGrace)
 			if err != nil {
+				log.Error("failed to detach", err)
+				leave()
 				return
 			}
 
-			if err := signer(req, id, nil); err != nil {
-				return
+			time.AfterFunc(cfg.ResumeGrace, func() {
+				expired, err := registry.Expire(context.Background(), id, left)
+				if err != nil {
+					log.Error("failed to expire detached connection", err)
+					return
+				}
+
+				if expired {
+					leave()
+				}
+			})
+		}()
+
+		countViolation := func() {
+			if err := registry.Increment(context.Background(), id, map[string]int64{"violations": 1}); err != nil {
+				log.Error("failed to update violation stats", err)
 			}
+		}
 
-			if len(meta) > 0 {
-				req.Header.Set("Websocket-Gateway-Meta", string(meta))
+		for _, event := range replay {
+			b, err := base64.RawURLEncoding.DecodeString(event.Payload)
+			if err != nil {
+				continue
+			}
+
+			typ := websocket.MessageText
+			if event.Binary {
+				typ = websocket.MessageBinary
+			}
+
+			split, err := writeMessage(ctx, conn, cfg, typ, b)
+			if split {
+				countViolation()
 			}
 
-			resp, err := hc.Do(req)
 			if err != nil {
+				log.Error("failed to replay message", err)
 				return
 			}
+		}
+
+		activity := NewActivity()
+
+		// every client message is the root of its own trace, linked to the join
+		forward := func(typ websocket.MessageType, b []byte) bool {
+			ctx, span := tracer.Start(
+				ctx,
+				"message",
+				trace.WithNewRoot(),
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithLinks(trace.Link{SpanContext: joinSpan.SpanContext()}),
+				connectionAttributes(id, route.Name),
+			)
+			defer span.End()
+
+			if allowed, err := limiter.Allow(ctx, len(b)); err != nil {
+				log.Error("failed to apply rate limits", err)
+			} else if !allowed {
+				countViolation()
+
+				switch cfg.RateAction {
+				case RateActionClose:
+					resumable.Store(false)
+					_ = conn.Close(websocket.StatusPolicyViolation, "rate limited")
+					return false
+				case RateActionWarn:
+					_ = queue.Push(Message{Buffer: rateWarning})
+				}
+
+				return true
+			}
 
-			//goland:noinspection GoUnhandledErrorResult
-			defer resp.Body.Close()
-		}()
+			if err := incrementStats(ctx, registry, id, "recv", len(b)); err != nil {
+				log.Error("failed to update received messages stats", err)
+				return false
+			}
+
+			// the message is dead lettered by now, the socket keeps going
+			if err := downstream.Message(ctx, session, typ == websocket.MessageBinary, b); errors.Is(err, ErrBreakerOpen) {
+				span.RecordError(err)
+				_ = conn.Close(websocket.StatusCode(cfg.BreakerCloseCode), "downstream unavailable")
+				return false
+			} else if err != nil {
+				span.RecordError(err)
+				log.Error("failed to forward message", err)
+			}
+
+			return true
+		}
 
 		go func() {
 			defer cancel()
 			for {
-				typ, b, err := conn.Read(ctx)
-				if err != nil {
+				typ, b, tooBig, err := readMessage(ctx, conn, cfg)
+				if tooBig {
+					log.Warn("client message too big")
+					countViolation()
+					resumable.Store(false)
 					return
-				}
-
-				if err := rdb.HIncrBy(ctx, rid, "recv", 1).Err(); err != nil {
-					log.Error("failed to update received messages stats", err)
-					return
-				}
-
-				req, err := http.NewRequest(http.MethodPost, downstream, bytes.NewReader(b))
-				if err != nil {
-					return
-				}
-
-				if err := signer(req, id, nil); err != nil {
+				} else if err != nil {
+					status := websocket.CloseStatus(err)
+					if status == websocket.StatusNormalClosure || status == websocket.StatusGoingAway {
+						resumable.Store(false)
+					}
 					return
 				}
 
-				if len(meta) > 0 {
-					req.Header.Set("Websocket-Gateway-Meta", string(meta))
-				}
-
-				if typ == websocket.MessageBinary {
-					req.Header.Set("Content-Type", "application/octet-stream")
-				} else {
-					req.Header.Set("Content-Type", "text/plain")
-				}
+				activity.Touch()
 
-				resp, err := hc.Do(req)
-				if err != nil {
+				if !forward(typ, b) {
 					return
 				}
-
-				//goland:noinspection GoUnhandledErrorResult
-				resp.Body.Close()
 			}
 		}()
 
@@ -200,14 +459,22 @@ func JoinRoute[T any](
 				select {
 				case <-ctx.Done():
 					return
-				case <-time.After(45 * time.Second):
+				case <-time.After(cfg.pingInterval()):
 					if err := conn.Ping(ctx); err != nil {
 						log.Error("failed to ping", err)
 						_ = conn.Close(websocket.StatusAbnormalClosure, "hello?")
 						return
 					}
 
-					if err := rdb.Expire(ctx, rid, 60*time.Second).Err(); err != nil {
+					if err := wire.Flush(ctx, registry, id); err != nil {
+						log.Error("failed to update wire stats", err)
+					}
+
+					if cfg.MaxConnectionsPerIP > 0 {
+						_ = limits.RefreshConnections(ctx, ip, cfg.connectionTTL())
+					}
+
+					if err := registry.Refresh(ctx, id, cfg.connectionTTL()); err != nil {
 						log.Error("failed extend exp", err)
 						_ = conn.Close(websocket.StatusAbnormalClosure, "it broke")
 						return
@@ -216,31 +483,139 @@ func JoinRoute[T any](
 			}
 		}()
 
+		drained := state.drained(ctx, cfg.DrainSpread)
+
+		var idle, expired <-chan time.Time
+		idleTimer := time.NewTimer(cfg.IdleTimeout)
+		defer idleTimer.Stop()
+		if cfg.IdleTimeout > 0 {
+			idle = idleTimer.C
+		}
+
+		if lifetime > 0 {
+			lifetimeTimer := time.NewTimer(time.Until(joined.Add(lifetime)))
+			defer lifetimeTimer.Stop()
+			expired = lifetimeTimer.C
+		}
+
 		for {
 			select {
 			case <-ctx.Done():
 				log.Info("left")
 				return
-			case msg := <-msgChan:
-				if msg.Drop {
-					return
+			case <-drained:
+				log.Info("drained")
+				resumable.Store(false)
+				_ = conn.Close(websocket.StatusCode(cfg.DrainCloseCode), cfg.DrainCloseReason)
+				return
+			case <-idle:
+				if since := activity.Since(); since < cfg.IdleTimeout {
+					idleTimer.Reset(cfg.IdleTimeout - since)
+					continue
 				}
 
-				typ := websocket.MessageText
-				if msg.Binary {
-					typ = websocket.MessageBinary
-				}
+				log.Info("idle")
+				resumable.Store(false)
+				_ = conn.Close(websocket.StatusNormalClosure, "idle timeout")
+				return
+			case <-expired:
+				log.Info("lifetime exceeded")
+				resumable.Store(false)
+				_ = conn.Close(websocket.StatusNormalClosure, "lifetime exceeded")
+				return
+			case <-queue.Slow():
+				log.Warn("disconnecting slow consumer")
+				resumable.Store(false)
+				_ = conn.Close(websocket.StatusPolicyViolation, "slow consumer")
+				return
+			case <-queue.Ready():
+				for {
+					msg, ok := queue.Pop()
+					if !ok {
+						break
+					}
 
-				if err := conn.Write(ctx, typ, msg.Buffer); err != nil {
-					log.Error("failed to write message", err)
-					return
+					if msg.Drop {
+						resumable.Store(false)
+						return
+					}
+
+					typ := websocket.MessageText
+					if msg.Binary {
+						typ = websocket.MessageBinary
+					}
+
+					split, err := writeMessage(ctx, conn, cfg, typ, msg.Buffer)
+					msg.written(err)
+
+					if split {
+						countViolation()
+					}
+
+					if err != nil {
+						log.Error("failed to write message", err)
+						return
+					}
+
+					activity.Touch()
+
+					if err := incrementStats(ctx, registry, id, "sent", len(msg.Buffer)); err != nil {
+						log.Error("failed to update sent messages stats", err)
+						return
+					}
 				}
+			}
+		}
+	}
+}
 
-				if err := rdb.HIncrBy(ctx, rid, "sent", 1).Err(); err != nil {
-					log.Error("failed to update sent messages stats", err)
-					return
+// incrementStats counts a message and its payload bytes, before compression.
+func incrementStats(ctx context.Context, registry Registry, id, direction string, size int) error {
+	metricMessages.WithLabelValues(direction).Inc()
+	metricMessageBytes.WithLabelValues(direction).Add(float64(size))
+
+	return registry.Increment(ctx, id, map[string]int64{direction: 1, direction + "_bytes": int64(size)})
+}
+
+// originPatterns looks the host up in the configured origins, an exact entry wins over a wildcard one. The origin
+// of the host itself is always accepted by the upgrade.
+func originPatterns(cfg Config, serviceDomains []string, host string) []string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.ToLower(host)
+
+	keys := []string{host}
+	if i := strings.Index(host, "."); i > 0 {
+		keys = append(keys, "*"+host[i:])
+	}
+
+	for _, key := range keys {
+		for pattern, origins := range cfg.Origins {
+			if strings.ToLower(pattern) != key {
+				continue
+			}
+
+			patterns := make([]string, 0)
+			for _, origin := range strings.Split(origins, ",") {
+				if origin = strings.TrimSpace(origin); origin != "" {
+					patterns = append(patterns, origin)
 				}
 			}
+
+			return patterns
 		}
 	}
+
+	return serviceDomains
+}
+
+func resumeTokenFrom(r *http.Request) string {
+	if token := r.Header.Get("Websocket-Gateway-Resume-Token"); token != "" {
+		return token
+	}
+
+	// browsers can not set headers on websocket requests
+	return r.URL.Query().Get("resume")
 }
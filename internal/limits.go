@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"unicode/utf8"
+
+	"nhooyr.io/websocket"
+)
+
+type OversizePolicy string
+
+const (
+	OversizePolicySplit  OversizePolicy = "split"
+	OversizePolicyReject OversizePolicy = "reject"
+)
+
+// violation counts a violation against the connections that belong to the route.
+func violation(ctx context.Context, registry Registry, route string, ids ...string) error {
+	records, err := registry.GetMany(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for i, record := range records {
+		if len(record) == 0 || (route != "" && record["route"] != route) {
+			continue
+		}
+
+		if err := registry.Increment(ctx, ids[i], map[string]int64{"violations": 1}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// limitBody caps the request body, reads past the limit fail with *http.MaxBytesError.
+func limitBody(w http.ResponseWriter, r *http.Request, cfg Config) {
+	if cfg.MaxBodySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodySize)
+	}
+}
+
+// bodyStatus is the response to a request whose body could not be read.
+func bodyStatus(err error) int {
+	var mErr *http.MaxBytesError
+	if errors.As(err, &mErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadRequest
+}
+
+func oversized(cfg Config, b []byte) bool {
+	return cfg.MaxMessageSize > 0 && len(b) > cfg.MaxMessageSize
+}
+
+// readLimit applies MaxFrameSize, the library closes the socket with 1009 once a client message goes past it. Zero
+// lifts the library's own default limit.
+func readLimit(conn *websocket.Conn, cfg Config) {
+	if cfg.MaxFrameSize > 0 {
+		conn.SetReadLimit(cfg.MaxFrameSize)
+	} else {
+		conn.SetReadLimit(1 << 62)
+	}
+}
+
+// readMessage is conn.Read that tells a message over the read limit apart from other errors. The library reads a
+// single byte past the limit before it gives up.
+func readMessage(ctx context.Context, conn *websocket.Conn, cfg Config) (websocket.MessageType, []byte, bool, error) {
+	typ, r, err := conn.Reader(ctx)
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil && cfg.MaxFrameSize > 0 && int64(len(b)) > cfg.MaxFrameSize {
+		return typ, nil, true, err
+	}
+
+	return typ, b, false, err
+}
+
+// writeMessage writes a message to the client, splitting it into several when it is over MaxMessageSize. Whether it
+// had to be split is returned.
+func writeMessage(ctx context.Context, conn *websocket.Conn, cfg Config, typ websocket.MessageType, b []byte) (bool, error) {
+	if !oversized(cfg, b) {
+		return false, conn.Write(ctx, typ, b)
+	}
+
+	for _, part := range split(b, cfg.MaxMessageSize, typ == websocket.MessageText) {
+		if err := conn.Write(ctx, typ, part); err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// split cuts b into parts of at most size bytes, text is only cut between runes.
+func split(b []byte, size int, text bool) [][]byte {
+	parts := make([][]byte, 0, len(b)/size+1)
+	for len(b) > size {
+		n := size
+		if text {
+			for n > 0 && !utf8.RuneStart(b[n]) {
+				n--
+			}
+
+			// a size smaller than a rune can not keep it whole
+			if n == 0 {
+				n = size
+			}
+		}
+
+		parts = append(parts, b[:n])
+		b = b[n:]
+	}
+
+	return append(parts, b)
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"nhooyr.io/websocket"
+)
+
+func TestSplit(t *testing.T) {
+	text := []byte(strings.Repeat("héllo wörld ", 10))
+
+	parts := split(text, 7, true)
+	if !bytes.Equal(bytes.Join(parts, nil), text) {
+		t.Fatal("parts do not add up to the message")
+	}
+
+	for _, part := range parts {
+		if len(part) > 7 {
+			t.Errorf("part of %v bytes over the limit", len(part))
+		}
+
+		if !utf8.Valid(part) {
+			t.Errorf("text split inside a rune: %q", part)
+		}
+	}
+
+	if parts := split([]byte("abcdef"), 2, false); len(parts) != 3 {
+		t.Errorf("expected 3 parts, got %v", len(parts))
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{MaxFrameSize: 16}
+
+	result := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		readLimit(conn, cfg)
+
+		if _, _, tooBig, _ := readMessage(ctx, conn, cfg); tooBig {
+			result <- false
+			return
+		}
+
+		_, _, tooBig, _ := readMessage(ctx, conn, cfg)
+		result <- tooBig
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.Dial(ctx, strings.Replace(server.URL, "http", "ws", 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.Write(ctx, websocket.MessageText, bytes.Repeat([]byte("a"), 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.Write(ctx, websocket.MessageText, bytes.Repeat([]byte("a"), 17)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !<-result {
+		t.Fatal("message over the limit not detected")
+	}
+
+	if _, _, err := conn.Read(ctx); websocket.CloseStatus(err) != websocket.StatusMessageTooBig {
+		t.Errorf("expected close with 1009, got %v", err)
+	}
+}
@@ -4,64 +4,97 @@ import (
 	"context"
 	"crypto/ed25519"
 	"encoding/base64"
-	"fmt"
+	"encoding/json"
 	"io"
 	"net/http"
-	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/manualpilot/auth"
-	"github.com/redis/go-redis/v9"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/exp/slog"
 )
 
+// Gateway is what Main sets up. Drain closes the connections of the instance, AllowDomain asks downstream whether a
+// certificate may be obtained for a custom domain.
+type Gateway struct {
+	Router      chi.Router
+	Drain       func(ctx context.Context) error
+	AllowDomain func(ctx context.Context, name string) error
+}
+
 func Main(
 	logger *slog.Logger,
 	ctx context.Context,
 	instanceID string,
-	rdb *redis.Client,
+	backend Backend,
 	bPrivateKey []byte,
 	downstream string,
-	serviceDomain string,
-) (chi.Router, error) {
+	serviceDomains []string,
+	cfg Config,
+) (*Gateway, error) {
 	privateKey := ed25519.PrivateKey(bPrivateKey)
+	signer := auth.NewRequestSigner[any](privateKey, "Websocket-Gateway-Auth")
 
-	b, err := Get(fmt.Sprintf("%v/.well-known/public.txt", downstream))
+	routes, err := NewRoutes(logger, backend.DeadLetters, signer, downstream, cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	logger.Debug("downstream public key", slog.String("public-key", string(b)))
+	state := NewState()
 
-	downstreamKey := make([]byte, base64.RawURLEncoding.DecodedLen(len(b)))
-	if _, err := base64.RawURLEncoding.Decode(downstreamKey, b); err != nil {
-		return nil, err
-	}
+	registry, bus := backend.Registry, backend.Bus
 
-	signer := auth.NewRequestSigner[any](privateKey, "Websocket-Gateway-Auth")
-	verifier := auth.NewRequestVerifier[any](downstreamKey, "Websocket-Gateway-Auth")
-
-	state := &State{
-		Lock:        sync.RWMutex{},
-		Connections: make(map[string]chan Message),
-	}
+	go SubscribeEvents(ctx, logger, state, bus, instanceID)
 
-	go SubscribeEvents(ctx, logger, state, rdb, instanceID)
+	join := JoinRoute(state, logger, registry, backend.Limits, routes, instanceID, serviceDomains, cfg)
 
 	router := chi.NewRouter()
 	router.Use(mid(instanceID))
-	router.Get("/health", health())
+	router.Get("/health", health(state, routes.Breakers))
 	router.Get("/.well-known/public.txt", publicKeyRoute(privateKey))
-	router.Get("/", JoinRoute(state, logger, rdb, signer, instanceID, downstream, serviceDomain))
-	router.Post("/", WriteHandler(state, rdb, verifier))
-	router.Delete("/", DropHandler(state, rdb, verifier))
+	router.Get("/", join)
+	router.Get("/*", join)
+	router.Post("/", WriteHandler(state, registry, bus, cfg, routes))
+	router.Delete("/", DropHandler(state, logger, registry, bus, routes))
+	router.Post("/bulk", BulkWriteHandler(state, logger, registry, bus, cfg, routes))
+	router.Post("/broadcast", BroadcastHandler(bus, cfg, routes))
+	router.Get("/connections", ListHandler(registry, routes))
+	router.Get("/connections/{id}", InspectHandler(registry, routes))
+	router.Head("/connections/{id}", AliveHandler(registry, routes))
+	router.Get("/dead-letters", DeadLettersHandler(backend.DeadLetters, routes))
+	router.Post("/dead-letters/replay", ReplayDeadLettersHandler(backend.DeadLetters, routes))
+	router.Delete("/dead-letters", PurgeDeadLettersHandler(backend.DeadLetters, routes))
+	router.Put("/channels/{name}", SubscribeHandler(registry, routes))
+	router.Delete("/channels/{name}", UnsubscribeHandler(registry, routes))
+	router.Post("/channels/{name}", PublishHandler(state, registry, bus, cfg, routes))
+
+	allowDomain := func(ctx context.Context, name string) error {
+		return routes.Domain(name).Downstream.Domain(ctx, name)
+	}
 
-	return router, nil
+	// what the instance keeps on the bus is of no use to anyone once its connections are gone, a drain that timed out
+	// leaves it for the restart to recover
+	drain := func(ctx context.Context) error {
+		if err := state.Drain(ctx); err != nil {
+			return err
+		}
+
+		return bus.Close(context.Background())
+	}
+
+	return &Gateway{Router: router, Drain: drain, AllowDomain: allowDomain}, nil
+}
+
+// AdminRouter serves what is only meant for operators, it must not be exposed publicly.
+func AdminRouter() chi.Router {
+	router := chi.NewRouter()
+	router.Handle("/metrics", promhttp.Handler())
+	return router
 }
 
-func Get(url string) ([]byte, error) {
-	client := http.Client{Timeout: 30 * time.Second}
+func Get(url string, timeout time.Duration) ([]byte, error) {
+	client := http.Client{Timeout: timeout}
 
 	resp, err := client.Get(url)
 	if err != nil {
@@ -74,9 +107,22 @@ func Get(url string) ([]byte, error) {
 	return io.ReadAll(resp.Body)
 }
 
-func health() http.HandlerFunc {
+type Health struct {
+	Draining    bool                    `json:"draining"`
+	Downstreams map[string]BreakerState `json:"downstreams"`
+}
+
+// health fails while draining, so the load balancer stops sending joins to the instance.
+func health(state *State, breakers func() map[string]BreakerState) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusNoContent)
+		status := http.StatusOK
+		if state.Draining() {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(Health{Draining: state.Draining(), Downstreams: breakers()})
 	}
 }
 
@@ -0,0 +1,489 @@
+package internal
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryStore is the single instance counterpart of RedisStore. Expiry is checked whenever a record is looked at, so
+// nothing runs in the background.
+type MemoryStore struct {
+	lock        sync.Mutex
+	records     map[string]*memoryRecord
+	channels    map[string]map[string]struct{}
+	memberships map[string]map[string]struct{}
+	letters     map[string][]DeadLetter
+	slots       map[string]*memoryCounter
+	rates       map[string]*memoryCounter
+}
+
+type memoryRecord struct {
+	fields  map[string]string
+	buffer  []Event
+	expires time.Time
+}
+
+// memoryCounter holds the messages of a second of an address, or the connection slots it has taken.
+type memoryCounter struct {
+	count   int64
+	bytes   int64
+	expires time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		records:     make(map[string]*memoryRecord),
+		channels:    make(map[string]map[string]struct{}),
+		memberships: make(map[string]map[string]struct{}),
+		letters:     make(map[string][]DeadLetter),
+		slots:       make(map[string]*memoryCounter),
+		rates:       make(map[string]*memoryCounter),
+	}
+}
+
+// record returns the live record of a connection, the caller holds the lock.
+func (s *MemoryStore) record(id string) *memoryRecord {
+	record, ok := s.records[id]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(record.expires) {
+		delete(s.records, id)
+		return nil
+	}
+
+	return record
+}
+
+func copyFields(fields map[string]string) map[string]string {
+	c := make(map[string]string, len(fields))
+	for key, value := range fields {
+		c[key] = value
+	}
+
+	return c
+}
+
+func (s *MemoryStore) Register(_ context.Context, id string, fields map[string]string, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record := s.record(id)
+	if record == nil {
+		record = &memoryRecord{fields: make(map[string]string)}
+		s.records[id] = record
+	}
+
+	for key, value := range fields {
+		record.fields[key] = value
+	}
+
+	record.expires = time.Now().Add(ttl)
+	return nil
+}
+
+func (s *MemoryStore) Refresh(_ context.Context, id string, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if record := s.record(id); record != nil {
+		record.expires = time.Now().Add(ttl)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Get(_ context.Context, id string) (map[string]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record := s.record(id)
+	if record == nil {
+		return map[string]string{}, nil
+	}
+
+	return copyFields(record.fields), nil
+}
+
+func (s *MemoryStore) GetMany(ctx context.Context, ids []string) ([]map[string]string, error) {
+	records := make([]map[string]string, len(ids))
+	for i, id := range ids {
+		records[i], _ = s.Get(ctx, id)
+	}
+
+	return records, nil
+}
+
+// List pages through the ids in order, the cursor is the offset of the next page.
+func (s *MemoryStore) List(_ context.Context, cursor uint64, count int64) ([]string, []map[string]string, uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	all := make([]string, 0, len(s.records))
+	for id := range s.records {
+		if s.record(id) != nil {
+			all = append(all, id)
+		}
+	}
+	sort.Strings(all)
+
+	if cursor >= uint64(len(all)) {
+		return []string{}, []map[string]string{}, 0, nil
+	}
+
+	end := cursor + uint64(count)
+	next := end
+	if end >= uint64(len(all)) {
+		end, next = uint64(len(all)), 0
+	}
+
+	ids := all[cursor:end]
+	records := make([]map[string]string, len(ids))
+	for i, id := range ids {
+		records[i] = copyFields(s.records[id].fields)
+	}
+
+	return ids, records, next, nil
+}
+
+func (s *MemoryStore) Increment(_ context.Context, id string, counters map[string]int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record := s.record(id)
+	if record == nil {
+		return nil
+	}
+
+	for field, n := range counters {
+		value, _ := strconv.ParseInt(record.fields[field], 10, 64)
+		record.fields[field] = strconv.FormatInt(value+n, 10)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Delete(_ context.Context, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.records, id)
+	return nil
+}
+
+func (s *MemoryStore) Detach(_ context.Context, id string, grace time.Duration) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	left := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	if record := s.record(id); record != nil {
+		record.fields["inst"] = ""
+		record.fields["left"] = left
+		record.expires = time.Now().Add(detachGrace(grace))
+	}
+
+	return left, nil
+}
+
+func (s *MemoryStore) Claim(_ context.Context, id, secret, instanceID string, ttl time.Duration) ([]Event, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record := s.record(id)
+	if record == nil || record.fields["inst"] != "" || record.fields["resume"] != secret {
+		return nil, false, nil
+	}
+
+	events := record.buffer
+	record.buffer = nil
+	record.fields["inst"] = instanceID
+	record.expires = time.Now().Add(ttl)
+
+	return events, true, nil
+}
+
+func (s *MemoryStore) Buffer(_ context.Context, id string, event Event, max int64, _ time.Duration) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record := s.record(id)
+	if record == nil {
+		return "", ErrNotFound
+	}
+
+	if inst := record.fields["inst"]; inst != "" {
+		return inst, nil
+	}
+
+	record.buffer = append(record.buffer, event)
+	if int64(len(record.buffer)) > max {
+		record.buffer = record.buffer[int64(len(record.buffer))-max:]
+	}
+
+	return "", nil
+}
+
+func (s *MemoryStore) Expire(_ context.Context, id, left string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record := s.record(id)
+	if record == nil || record.fields["inst"] != "" || record.fields["left"] != left {
+		return false, nil
+	}
+
+	delete(s.records, id)
+	return true, nil
+}
+
+func (s *MemoryStore) Subscribe(_ context.Context, route, channel, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := channelKey(route, channel)
+
+	if s.channels[key] == nil {
+		s.channels[key] = make(map[string]struct{})
+	}
+	s.channels[key][id] = struct{}{}
+
+	if s.memberships[id] == nil {
+		s.memberships[id] = make(map[string]struct{})
+	}
+	s.memberships[id][key] = struct{}{}
+
+	return nil
+}
+
+func (s *MemoryStore) Unsubscribe(_ context.Context, route, channel, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := channelKey(route, channel)
+	delete(s.channels[key], id)
+	delete(s.memberships[id], key)
+
+	return nil
+}
+
+func (s *MemoryStore) Members(_ context.Context, route, channel string) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	members := make([]string, 0, len(s.channels[channelKey(route, channel)]))
+	for id := range s.channels[channelKey(route, channel)] {
+		members = append(members, id)
+	}
+
+	return members, nil
+}
+
+func (s *MemoryStore) Prune(_ context.Context, route, channel string, ids []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := channelKey(route, channel)
+	for _, id := range ids {
+		delete(s.channels[key], id)
+		delete(s.memberships[id], key)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) LeaveChannels(_ context.Context, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key := range s.memberships[id] {
+		delete(s.channels[key], id)
+	}
+	delete(s.memberships, id)
+
+	return nil
+}
+
+func (s *MemoryStore) Push(_ context.Context, letter DeadLetter, max int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	letters := append(s.letters[letter.Route], letter)
+	if max > 0 && int64(len(letters)) > max {
+		letters = letters[int64(len(letters))-max:]
+	}
+
+	s.letters[letter.Route] = letters
+	return nil
+}
+
+func (s *MemoryStore) Peek(_ context.Context, route string, count int64) ([]DeadLetter, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	letters := s.letters[route]
+	if count > int64(len(letters)) {
+		count = int64(len(letters))
+	}
+
+	return append([]DeadLetter{}, letters[:count]...), nil
+}
+
+func (s *MemoryStore) Pop(_ context.Context, route string) (DeadLetter, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	letters := s.letters[route]
+	if len(letters) == 0 {
+		return DeadLetter{}, false, nil
+	}
+
+	s.letters[route] = letters[1:]
+	return letters[0], true, nil
+}
+
+func (s *MemoryStore) Len(_ context.Context, route string) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return int64(len(s.letters[route])), nil
+}
+
+func (s *MemoryStore) Purge(_ context.Context, route string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.letters, route)
+	return nil
+}
+
+// counter returns the live counter under key, starting a new one that lasts for ttl when there is none.
+func counter(counters map[string]*memoryCounter, key string, ttl time.Duration) *memoryCounter {
+	c, ok := counters[key]
+	if !ok || time.Now().After(c.expires) {
+		c = &memoryCounter{}
+		counters[key] = c
+	}
+
+	c.expires = time.Now().Add(ttl)
+	return c
+}
+
+func (s *MemoryStore) AcquireConnection(_ context.Context, ip string, max int64, ttl time.Duration) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c := counter(s.slots, ip, ttl)
+	if c.count >= max {
+		return false, nil
+	}
+
+	c.count++
+	return true, nil
+}
+
+func (s *MemoryStore) RefreshConnections(_ context.Context, ip string, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if c, ok := s.slots[ip]; ok {
+		c.expires = time.Now().Add(ttl)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) ReleaseConnection(_ context.Context, ip string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if c, ok := s.slots[ip]; ok {
+		c.count--
+		if c.count <= 0 {
+			delete(s.slots, ip)
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) CountMessage(_ context.Context, ip string, size int) (int64, int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// stale seconds are dropped as they are replaced, one per address at most lingers
+	c := counter(s.rates, ipRateKey(ip, time.Now()), 2*time.Second)
+	delete(s.rates, ipRateKey(ip, time.Now().Add(-time.Second)))
+
+	c.count++
+	c.bytes += int64(size)
+	return c.count, c.bytes, nil
+}
+
+// MemoryBus hands events to the subscribers of this process.
+type MemoryBus struct {
+	lock        sync.RWMutex
+	subscribers map[string][]chan Event
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{subscribers: make(map[string][]chan Event)}
+}
+
+func (b *MemoryBus) Publish(ctx context.Context, channel string, event Event) error {
+	b.lock.RLock()
+	subscribers := b.subscribers[channel]
+	b.lock.RUnlock()
+
+	for _, events := range subscribers {
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func (b *MemoryBus) Close(context.Context) error {
+	return nil
+}
+
+func (b *MemoryBus) Subscribe(ctx context.Context, channels []string, handler func(event Event, ack func())) {
+	events := make(chan Event, 1024)
+
+	b.lock.Lock()
+	for _, channel := range channels {
+		b.subscribers[channel] = append(b.subscribers[channel], events)
+	}
+	b.lock.Unlock()
+
+	defer func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		for _, channel := range channels {
+			subscribers := b.subscribers[channel]
+			for i, subscriber := range subscribers {
+				if subscriber == events {
+					b.subscribers[channel] = append(subscribers[:i:i], subscribers[i+1:]...)
+					break
+				}
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			handler(event, func() {})
+		}
+	}
+}
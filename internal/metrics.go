@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are process wide, every instance is scraped on its own admin listener.
+var (
+	metricConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "wsg_connections",
+		Help: "Sockets currently open on this instance.",
+	}, []string{"route"})
+
+	metricJoins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wsg_joins_total",
+		Help: "Sockets accepted, including resumed ones.",
+	}, []string{"route"})
+
+	metricLeaves = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wsg_leaves_total",
+		Help: "Sockets closed.",
+	}, []string{"route"})
+
+	metricJoinDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wsg_join_duration_seconds",
+		Help:    "Time from the join request to the upgraded socket, including the downstream call.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+
+	metricMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wsg_messages_total",
+		Help: "Messages read from (recv) and written to (sent) sockets.",
+	}, []string{"direction"})
+
+	metricMessageBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wsg_message_bytes_total",
+		Help: "Payload bytes read from (recv) and written to (sent) sockets.",
+	}, []string{"direction"})
+
+	metricDownstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wsg_downstream_duration_seconds",
+		Help:    "Downstream call latency by method and response status, \"error\" when there was no response.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	metricBusEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wsg_bus_events_total",
+		Help: "Cross instance events published and received.",
+	}, []string{"direction", "type"})
+
+	metricQueuedMessages = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "wsg_queued_messages",
+		Help: "Messages waiting in the outbound queues of this instance.",
+	})
+
+	metricQueuedBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "wsg_queued_bytes",
+		Help: "Payload bytes waiting in the outbound queues of this instance.",
+	})
+)
+
+func observeDownstream(route, method string, start time.Time, status int) {
+	label := "error"
+	if status > 0 {
+		label = strconv.Itoa(status)
+	}
+
+	metricDownstreamDuration.WithLabelValues(route, method, label).Observe(time.Since(start).Seconds())
+}
+
+// instrumentedBus counts the events going through a bus.
+type instrumentedBus struct {
+	Bus
+}
+
+func (b instrumentedBus) Publish(ctx context.Context, channel string, event Event) error {
+	if err := b.Bus.Publish(ctx, channel, event); err != nil {
+		return err
+	}
+
+	metricBusEvents.WithLabelValues("published", string(event.Type)).Inc()
+	return nil
+}
+
+func (b instrumentedBus) Subscribe(ctx context.Context, channels []string, handler func(event Event, ack func())) {
+	b.Bus.Subscribe(ctx, channels, func(event Event, ack func()) {
+		metricBusEvents.WithLabelValues("received", string(event.Type)).Inc()
+		handler(event, ack)
+	})
+}
@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type QueuePolicy string
+
+const (
+	QueuePolicyBlock      QueuePolicy = "block"
+	QueuePolicyDropOldest QueuePolicy = "drop-oldest"
+	QueuePolicyDropNewest QueuePolicy = "drop-newest"
+	QueuePolicyDisconnect QueuePolicy = "disconnect"
+)
+
+var (
+	ErrQueueFull    = errors.New("queue full")
+	ErrQueueTimeout = errors.New("timed out waiting for queue space")
+	ErrQueueClosed  = errors.New("queue closed")
+	ErrSlowConsumer = errors.New("slow consumer disconnected")
+	// ErrEvicted is handed to Message.Written when a message made room for a newer one without being written.
+	ErrEvicted = errors.New("evicted from queue")
+)
+
+// Queue holds the messages waiting to be written to one socket. Depth and size are bounded, what happens to a
+// message that does not fit depends on the policy. A drop is kept apart from the messages, so it always fits, jumps
+// the line and is never evicted.
+type Queue struct {
+	lock     sync.Mutex
+	items    []Message
+	drop     bool
+	size     int
+	depth    int
+	maxBytes int
+	policy   QueuePolicy
+	timeout  time.Duration
+	ready    chan struct{}
+	space    chan struct{}
+	slow     chan struct{}
+	closed   bool
+}
+
+func NewQueue(cfg Config) *Queue {
+	policy := cfg.QueuePolicy
+	if policy == "" {
+		policy = QueuePolicyBlock
+	}
+
+	return &Queue{
+		items:    make([]Message, 0),
+		depth:    cfg.QueueDepth,
+		maxBytes: cfg.QueueBytes,
+		policy:   policy,
+		timeout:  cfg.QueueTimeout,
+		ready:    make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+		slow:     make(chan struct{}),
+	}
+}
+
+// Ready is signalled whenever a message has been pushed.
+func (q *Queue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Slow is closed once the disconnect policy gave up on the consumer.
+func (q *Queue) Slow() <-chan struct{} {
+	return q.slow
+}
+
+func (q *Queue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.items)
+}
+
+// Push queues a message, with the block policy it waits for room.
+func (q *Queue) Push(msg Message) error {
+	return q.push(msg, true)
+}
+
+// Offer queues a message without ever waiting, with the block policy a message that does not fit is refused like
+// with drop-newest.
+func (q *Queue) Offer(msg Message) error {
+	return q.push(msg, false)
+}
+
+func (q *Queue) push(msg Message, wait bool) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	if msg.Drop {
+		q.drop = true
+		signal(q.ready)
+		return nil
+	}
+
+	deadline := time.Now().Add(q.timeout)
+	for !q.fits(msg) {
+		switch q.policy {
+		case QueuePolicyDropNewest:
+			return ErrQueueFull
+		case QueuePolicyDropOldest:
+			q.pop().written(ErrEvicted)
+		case QueuePolicyDisconnect:
+			q.closed = true
+			close(q.slow)
+			return ErrSlowConsumer
+		default:
+			if !wait {
+				return ErrQueueFull
+			}
+
+			left := time.Until(deadline)
+			if left <= 0 {
+				return ErrQueueTimeout
+			}
+
+			q.lock.Unlock()
+			select {
+			case <-q.space:
+			case <-time.After(left):
+			}
+			q.lock.Lock()
+
+			if q.closed {
+				return ErrQueueClosed
+			}
+		}
+	}
+
+	q.items = append(q.items, msg)
+	q.size += len(msg.Buffer)
+	metricQueuedMessages.Inc()
+	metricQueuedBytes.Add(float64(len(msg.Buffer)))
+	signal(q.ready)
+
+	return nil
+}
+
+// Pop returns the next message without waiting.
+func (q *Queue) Pop() (Message, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.drop {
+		q.drop = false
+		return Message{Drop: true}, true
+	}
+
+	if len(q.items) == 0 {
+		return Message{}, false
+	}
+
+	return q.pop(), true
+}
+
+// Close rejects further messages and tells the ones still waiting that they were never written.
+func (q *Queue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	for len(q.items) > 0 {
+		q.pop().written(ErrQueueClosed)
+	}
+	signal(q.space)
+}
+
+func (q *Queue) fits(msg Message) bool {
+	// a single message is always let through, otherwise one oversized payload would wedge the queue
+	if len(q.items) == 0 {
+		return true
+	}
+
+	if q.depth > 0 && len(q.items) >= q.depth {
+		return false
+	}
+
+	return q.maxBytes <= 0 || q.size+len(msg.Buffer) <= q.maxBytes
+}
+
+func (q *Queue) pop() Message {
+	msg := q.items[0]
+	q.items = q.items[1:]
+	q.size -= len(msg.Buffer)
+	metricQueuedMessages.Dec()
+	metricQueuedBytes.Sub(float64(len(msg.Buffer)))
+	signal(q.space)
+	return msg
+}
+
+func (m Message) written(err error) {
+	if m.Written != nil {
+		m.Written(err)
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
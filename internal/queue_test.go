@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+	msg := func(s string) Message {
+		return Message{Buffer: []byte(s)}
+	}
+
+	q := NewQueue(Config{QueueDepth: 2, QueuePolicy: QueuePolicyDropNewest})
+	_ = q.Push(msg("a"))
+	_ = q.Push(msg("b"))
+	if err := q.Push(msg("c")); err != ErrQueueFull {
+		t.Error("drop-newest accepted a message over depth")
+	}
+
+	evicted := false
+	q = NewQueue(Config{QueueDepth: 2, QueuePolicy: QueuePolicyDropOldest})
+	_ = q.Push(Message{Buffer: []byte("a"), Written: func(err error) { evicted = err == ErrEvicted }})
+	_ = q.Push(msg("b"))
+	if err := q.Push(msg("c")); err != nil {
+		t.Error("drop-oldest refused a message")
+	}
+
+	if m, _ := q.Pop(); !evicted || string(m.Buffer) != "b" {
+		t.Error("drop-oldest did not evict the oldest message")
+	}
+
+	q = NewQueue(Config{QueueBytes: 4, QueuePolicy: QueuePolicyDisconnect})
+	_ = q.Push(msg("abc"))
+	if err := q.Push(msg("de")); err != ErrSlowConsumer {
+		t.Error("disconnect policy accepted a message over the byte limit")
+	}
+
+	select {
+	case <-q.Slow():
+	default:
+		t.Error("slow consumer not signalled")
+	}
+
+	q = NewQueue(Config{QueueDepth: 1, QueuePolicy: QueuePolicyBlock, QueueTimeout: 50 * time.Millisecond})
+	_ = q.Push(msg("a"))
+	if err := q.Push(msg("b")); err != ErrQueueTimeout {
+		t.Error("block policy did not time out")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Pop()
+	}()
+
+	if err := q.Push(msg("c")); err != nil {
+		t.Error("block policy did not wait for room")
+	}
+
+	_ = q.Push(Message{Drop: true})
+	if m, _ := q.Pop(); !m.Drop {
+		t.Error("drop message did not jump the line")
+	}
+
+	// a pending drop is not the oldest message to evict
+	q = NewQueue(Config{QueueDepth: 1, QueuePolicy: QueuePolicyDropOldest})
+	_ = q.Push(msg("a"))
+	_ = q.Push(Message{Drop: true})
+	_ = q.Push(msg("b"))
+	if m, _ := q.Pop(); !m.Drop {
+		t.Error("drop message evicted")
+	}
+
+	// offering never waits, the block policy refuses what does not fit right away
+	q = NewQueue(Config{QueueDepth: 1, QueuePolicy: QueuePolicyBlock, QueueTimeout: time.Minute})
+	_ = q.Push(msg("a"))
+	if err := q.Offer(msg("b")); err != ErrQueueFull {
+		t.Error("offer to a full queue did not refuse the message")
+	}
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type RateAction string
+
+const (
+	RateActionDrop  RateAction = "drop"
+	RateActionWarn  RateAction = "warn"
+	RateActionClose RateAction = "close"
+)
+
+// rateWarning is the text message a client gets for every frame dropped with RateActionWarn.
+var rateWarning = []byte(`{"error":"rate_limited"}`)
+
+// Bucket is a token bucket that holds up to a second worth of its rate. It is used by the socket's reader only and
+// not safe for concurrent use.
+type Bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate float64) *Bucket {
+	return &Bucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// Take removes n tokens if there are enough, a bucket without a rate never runs out.
+func (b *Bucket) Take(n float64) bool {
+	if b == nil || b.rate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	// a message bigger than the whole bucket gets through on a full bucket, or it could never be sent
+	if b.tokens < n && b.tokens < b.rate {
+		return false
+	}
+
+	b.tokens -= n
+	return true
+}
+
+// Limiter applies the per connection buckets and the cluster wide limits of the client address to the messages
+// read from one socket.
+type Limiter struct {
+	limits   Limits
+	cfg      Config
+	ip       string
+	messages *Bucket
+	bytes    *Bucket
+}
+
+func NewLimiter(limits Limits, cfg Config, ip string) *Limiter {
+	return &Limiter{
+		limits:   limits,
+		cfg:      cfg,
+		ip:       ip,
+		messages: NewBucket(cfg.RateMessages),
+		bytes:    NewBucket(cfg.RateBytes),
+	}
+}
+
+func (l *Limiter) Allow(ctx context.Context, size int) (bool, error) {
+	// both buckets are always charged, a message that is refused still used up what it was allowed
+	messages, bytes := l.messages.Take(1), l.bytes.Take(float64(size))
+	if !messages || !bytes {
+		return false, nil
+	}
+
+	if l.cfg.IPRateMessages <= 0 && l.cfg.IPRateBytes <= 0 {
+		return true, nil
+	}
+
+	total, totalBytes, err := l.limits.CountMessage(ctx, l.ip, size)
+	if err != nil {
+		return false, err
+	}
+
+	if l.cfg.IPRateMessages > 0 && total > l.cfg.IPRateMessages {
+		return false, nil
+	}
+
+	if l.cfg.IPRateBytes > 0 && totalBytes > l.cfg.IPRateBytes {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// acquireConnection takes one of the concurrent connection slots of the client address. The returned func gives it
+// back, the count expires on its own should the instance die before.
+func acquireConnection(ctx context.Context, limits Limits, cfg Config, ip string) (func(), bool, error) {
+	if cfg.MaxConnectionsPerIP <= 0 {
+		return func() {}, true, nil
+	}
+
+	ok, err := limits.AcquireConnection(ctx, ip, cfg.MaxConnectionsPerIP, cfg.connectionTTL())
+	if err != nil || !ok {
+		return func() {}, false, err
+	}
+
+	return func() {
+		_ = limits.ReleaseConnection(context.Background(), ip)
+	}, true, nil
+}
+
+// clientIP is the address of the client, taken from ClientIPHeader when the gateway runs behind a proxy.
+func clientIP(r *http.Request, cfg Config) string {
+	if cfg.ClientIPHeader != "" {
+		// proxies append what they saw to X-Forwarded-For, only the entries added by our own can be trusted
+		hops := cfg.TrustedProxies
+		if hops <= 0 {
+			hops = 1
+		}
+
+		entries := strings.Split(strings.Join(r.Header.Values(cfg.ClientIPHeader), ","), ",")
+		if len(entries) >= hops {
+			if ip := strings.TrimSpace(entries[len(entries)-hops]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
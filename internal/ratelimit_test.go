@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestBucket(t *testing.T) {
+	bucket := NewBucket(10)
+
+	for i := 0; i < 10; i++ {
+		if !bucket.Take(1) {
+			t.Fatalf("message %v refused within the rate", i)
+		}
+	}
+
+	if bucket.Take(1) {
+		t.Error("message over the rate allowed")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if !bucket.Take(1) {
+		t.Error("bucket did not refill")
+	}
+
+	if !NewBucket(0).Take(1000) {
+		t.Error("bucket without a rate refused a message")
+	}
+}
+
+func TestConnectionsPerIP(t *testing.T) {
+	ctx := context.Background()
+
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" {
+		redisAddr = "localhost:6379"
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
+	if err := rdb.Del(ctx, ipConnectionsKey("192.0.2.1")).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	limits := &RedisStore{rdb: rdb}
+	cfg := Config{MaxConnectionsPerIP: 2}
+
+	releases := make([]func(), 0)
+	for i := 0; i < 2; i++ {
+		release, ok, err := acquireConnection(ctx, limits, cfg, "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("connection %v refused within the limit", i)
+		}
+
+		releases = append(releases, release)
+	}
+
+	if _, ok, _ := acquireConnection(ctx, limits, cfg, "192.0.2.1"); ok {
+		t.Fatal("connection over the limit allowed")
+	}
+
+	releases[0]()
+
+	if _, ok, _ := acquireConnection(ctx, limits, cfg, "192.0.2.1"); !ok {
+		t.Error("released slot not given out again")
+	}
+
+	// slots that lapsed before they were released do not free up more than the limit
+	if err := rdb.Del(ctx, ipConnectionsKey("192.0.2.1")).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	releases[1]()
+
+	if exists := rdb.Exists(ctx, ipConnectionsKey("192.0.2.1")).Val(); exists != 0 {
+		t.Error("released a lapsed slot")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, ok, _ := acquireConnection(ctx, limits, cfg, "192.0.2.1"); !ok {
+			t.Fatalf("connection %v refused within the limit", i)
+		}
+	}
+
+	if _, ok, _ := acquireConnection(ctx, limits, cfg, "192.0.2.1"); ok {
+		t.Error("connection over the limit allowed after a lapsed release")
+	}
+
+	if ttl := rdb.PTTL(ctx, ipConnectionsKey("192.0.2.1")).Val(); ttl <= 0 {
+		t.Errorf("slots lost their expiry, %v", ttl)
+	}
+
+	releases[0]()
+
+	if ttl := rdb.PTTL(ctx, ipConnectionsKey("192.0.2.1")).Val(); ttl <= 0 {
+		t.Errorf("release dropped the expiry, %v", ttl)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+	r.Header.Add("X-Forwarded-For", "192.0.2.1")
+
+	cases := []struct {
+		cfg      Config
+		expected string
+	}{
+		{Config{}, "10.0.0.1"},
+		// the leftmost entry is whatever the client sent
+		{Config{ClientIPHeader: "X-Forwarded-For"}, "192.0.2.1"},
+		{Config{ClientIPHeader: "X-Forwarded-For", TrustedProxies: 2}, "198.51.100.7"},
+		{Config{ClientIPHeader: "X-Forwarded-For", TrustedProxies: 4}, "10.0.0.1"},
+		{Config{ClientIPHeader: "Fly-Client-IP"}, "10.0.0.1"},
+	}
+
+	for _, c := range cases {
+		if ip := clientIP(r, c.cfg); ip != c.expected {
+			t.Errorf("expected %v from %v behind %v proxies, got %v", c.expected, c.cfg.ClientIPHeader, c.cfg.TrustedProxies, ip)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStore shares connection records, dead letters and address limits between the instances of a cluster. A
+// record is the ws: hash of the connection.
+//
+// A detached connection keeps its ws: hash with an empty "inst" field for the grace window. Writes that arrive in the
+// meantime are appended to a bounded buffer which is replayed once the client comes back with its token.
+type RedisStore struct {
+	rdb redis.UniversalClient
+}
+
+func deadLetterKey(route string) string {
+	return fmt.Sprintf("dlq:%v", route)
+}
+
+var incrementScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+for i = 1, #ARGV, 2 do
+	redis.call("HINCRBY", KEYS[1], ARGV[i], ARGV[i + 1])
+end
+return 1
+`)
+
+var bufferScript = redis.NewScript(`
+local inst = redis.call("HGET", KEYS[1], "inst")
+if inst == false then
+	return false
+end
+if inst ~= "" then
+	return inst
+end
+redis.call("RPUSH", KEYS[2], ARGV[1])
+redis.call("LTRIM", KEYS[2], -tonumber(ARGV[2]), -1)
+redis.call("PEXPIRE", KEYS[2], ARGV[3])
+return ""
+`)
+
+var claimScript = redis.NewScript(`
+local data = redis.call("HMGET", KEYS[1], "inst", "resume")
+if data[1] ~= "" or data[2] ~= ARGV[1] then
+	return false
+end
+redis.call("HSET", KEYS[1], "inst", ARGV[2])
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+redis.call("PERSIST", KEYS[3])
+local buffered = redis.call("LRANGE", KEYS[2], 0, -1)
+redis.call("DEL", KEYS[2])
+return buffered
+`)
+
+var expireScript = redis.NewScript(`
+local data = redis.call("HMGET", KEYS[1], "inst", "left")
+if data[1] ~= "" or data[2] ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", KEYS[1], KEYS[2])
+return 1
+`)
+
+// ipRateScript counts a message against the current second of a client address and returns the totals so far.
+var ipRateScript = redis.NewScript(`
+local messages = redis.call("HINCRBY", KEYS[1], "messages", 1)
+local bytes = redis.call("HINCRBY", KEYS[1], "bytes", ARGV[1])
+redis.call("EXPIRE", KEYS[1], 2)
+return {messages, bytes}
+`)
+
+// ipConnectionsScript takes a connection slot of a client address, giving it back when there is none left.
+var ipConnectionsScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+if n > tonumber(ARGV[1]) then
+	redis.call("DECR", KEYS[1])
+	return 0
+end
+return 1
+`)
+
+// releaseConnectionScript gives a slot back. A count that lapsed with its instance stays gone rather than going
+// negative and handing out slots over the limit, DECR keeps the expiry of the rest.
+var releaseConnectionScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+if redis.call("DECR", KEYS[1]) <= 0 then
+	redis.call("DEL", KEYS[1])
+end
+return 1
+`)
+
+func bufferKey(id string) string {
+	return fmt.Sprintf("buf:{%v}", id)
+}
+
+func ipRateKey(ip string, now time.Time) string {
+	return fmt.Sprintf("rl:%v:%v", ip, now.Unix())
+}
+
+func ipConnectionsKey(ip string) string {
+	return fmt.Sprintf("ipc:%v", ip)
+}
+
+func (s *RedisStore) Register(ctx context.Context, id string, fields map[string]string, ttl time.Duration) error {
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, connectionKey(id), fields)
+		pipe.PExpire(ctx, connectionKey(id), ttl)
+		return nil
+	})
+
+	return err
+}
+
+func (s *RedisStore) Refresh(ctx context.Context, id string, ttl time.Duration) error {
+	return s.rdb.PExpire(ctx, connectionKey(id), ttl).Err()
+}
+
+func (s *RedisStore) Get(ctx context.Context, id string) (map[string]string, error) {
+	return s.rdb.HGetAll(ctx, connectionKey(id)).Result()
+}
+
+func (s *RedisStore) GetMany(ctx context.Context, ids []string) ([]map[string]string, error) {
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = pipe.HGetAll(ctx, connectionKey(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]map[string]string, len(cmds))
+	for i, cmd := range cmds {
+		records[i] = cmd.Val()
+	}
+
+	return records, nil
+}
+
+// List runs a single SCAN step, on a cluster one step of one master at a time.
+func (s *RedisStore) List(ctx context.Context, cursor uint64, count int64) ([]string, []map[string]string, uint64, error) {
+	keys, next, err := Scan(ctx, s.rdb, cursor, connectionKey("*"), count, "hash")
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = connectionID(key)
+	}
+
+	records, err := s.GetMany(ctx, ids)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	// the connection may have left between SCAN and HGETALL
+	live, liveRecords := make([]string, 0, len(ids)), make([]map[string]string, 0, len(ids))
+	for i, record := range records {
+		if len(record) > 0 {
+			live, liveRecords = append(live, ids[i]), append(liveRecords, record)
+		}
+	}
+
+	return live, liveRecords, next, nil
+}
+
+func (s *RedisStore) Increment(ctx context.Context, id string, counters map[string]int64) error {
+	args := make([]interface{}, 0, 2*len(counters))
+	for field, n := range counters {
+		args = append(args, field, n)
+	}
+
+	return incrementScript.Run(ctx, s.rdb, []string{connectionKey(id)}, args...).Err()
+}
+
+func (s *RedisStore) Delete(ctx context.Context, id string) error {
+	return s.rdb.Del(ctx, connectionKey(id), bufferKey(id)).Err()
+}
+
+func (s *RedisStore) Detach(ctx context.Context, id string, grace time.Duration) (string, error) {
+	left := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, connectionKey(id), "inst", "", "left", left)
+		pipe.PExpire(ctx, connectionKey(id), detachGrace(grace))
+		pipe.PExpire(ctx, membershipKey(id), detachGrace(grace))
+		return nil
+	})
+
+	return left, err
+}
+
+func (s *RedisStore) Claim(ctx context.Context, id, secret, instanceID string, ttl time.Duration) ([]Event, bool, error) {
+	keys := []string{connectionKey(id), bufferKey(id), membershipKey(id)}
+
+	res, err := claimScript.Run(ctx, s.rdb, keys, secret, instanceID, ttl.Milliseconds()).StringSlice()
+	if err == redis.Nil {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	events := make([]Event, 0, len(res))
+	for _, item := range res {
+		event := Event{}
+		if err := json.Unmarshal([]byte(item), &event); err != nil {
+			return nil, false, err
+		}
+
+		events = append(events, event)
+	}
+
+	return events, true, nil
+}
+
+func (s *RedisStore) Buffer(ctx context.Context, id string, event Event, max int64, grace time.Duration) (string, error) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+
+	keys := []string{connectionKey(id), bufferKey(id)}
+	inst, err := bufferScript.Run(ctx, s.rdb, keys, string(b), max, detachGrace(grace).Milliseconds()).Text()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+
+	return inst, err
+}
+
+func (s *RedisStore) Expire(ctx context.Context, id, left string) (bool, error) {
+	keys := []string{connectionKey(id), bufferKey(id)}
+	return expireScript.Run(ctx, s.rdb, keys, left).Bool()
+}
+
+func (s *RedisStore) Subscribe(ctx context.Context, route, channel, id string) error {
+	key := channelKey(route, channel)
+
+	// the channel and membership keys hash to different slots, so they can not be updated in one transaction
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, key, id)
+		pipe.SAdd(ctx, membershipKey(id), key)
+		return nil
+	})
+
+	return err
+}
+
+func (s *RedisStore) Unsubscribe(ctx context.Context, route, channel, id string) error {
+	key := channelKey(route, channel)
+
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SRem(ctx, key, id)
+		pipe.SRem(ctx, membershipKey(id), key)
+		return nil
+	})
+
+	return err
+}
+
+func (s *RedisStore) Members(ctx context.Context, route, channel string) ([]string, error) {
+	return s.rdb.SMembers(ctx, channelKey(route, channel)).Result()
+}
+
+func (s *RedisStore) Prune(ctx context.Context, route, channel string, ids []string) error {
+	return s.rdb.SRem(ctx, channelKey(route, channel), ids).Err()
+}
+
+func (s *RedisStore) LeaveChannels(ctx context.Context, id string) error {
+	keys, err := s.rdb.SMembers(ctx, membershipKey(id)).Result()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.SRem(ctx, key, id)
+		}
+		pipe.Del(ctx, membershipKey(id))
+		return nil
+	})
+
+	return err
+}
+
+func (s *RedisStore) Push(ctx context.Context, letter DeadLetter, max int64) error {
+	b, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, deadLetterKey(letter.Route), string(b))
+		if max > 0 {
+			pipe.LTrim(ctx, deadLetterKey(letter.Route), -max, -1)
+		}
+		return nil
+	})
+
+	return err
+}
+
+func (s *RedisStore) Peek(ctx context.Context, route string, count int64) ([]DeadLetter, error) {
+	items, err := s.rdb.LRange(ctx, deadLetterKey(route), 0, count-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]DeadLetter, 0, len(items))
+	for _, item := range items {
+		letter := DeadLetter{}
+		if err := json.Unmarshal([]byte(item), &letter); err != nil {
+			continue
+		}
+
+		letters = append(letters, letter)
+	}
+
+	return letters, nil
+}
+
+func (s *RedisStore) Pop(ctx context.Context, route string) (DeadLetter, bool, error) {
+	item, err := s.rdb.LPop(ctx, deadLetterKey(route)).Result()
+	if err == redis.Nil {
+		return DeadLetter{}, false, nil
+	} else if err != nil {
+		return DeadLetter{}, false, err
+	}
+
+	letter := DeadLetter{}
+	if err := json.Unmarshal([]byte(item), &letter); err != nil {
+		if err := s.rdb.RPush(ctx, deadLetterKey(route), item).Err(); err != nil {
+			return DeadLetter{}, false, err
+		}
+
+		return DeadLetter{}, true, ErrUnreadableLetter
+	}
+
+	return letter, true, nil
+}
+
+func (s *RedisStore) Len(ctx context.Context, route string) (int64, error) {
+	return s.rdb.LLen(ctx, deadLetterKey(route)).Result()
+}
+
+func (s *RedisStore) Purge(ctx context.Context, route string) error {
+	return s.rdb.Del(ctx, deadLetterKey(route)).Err()
+}
+
+func (s *RedisStore) AcquireConnection(ctx context.Context, ip string, max int64, ttl time.Duration) (bool, error) {
+	return ipConnectionsScript.Run(ctx, s.rdb, []string{ipConnectionsKey(ip)}, max, ttl.Milliseconds()).Bool()
+}
+
+func (s *RedisStore) RefreshConnections(ctx context.Context, ip string, ttl time.Duration) error {
+	return s.rdb.PExpire(ctx, ipConnectionsKey(ip), ttl).Err()
+}
+
+func (s *RedisStore) ReleaseConnection(ctx context.Context, ip string) error {
+	return releaseConnectionScript.Run(ctx, s.rdb, []string{ipConnectionsKey(ip)}).Err()
+}
+
+func (s *RedisStore) CountMessage(ctx context.Context, ip string, size int) (int64, int64, error) {
+	totals, err := ipRateScript.Run(ctx, s.rdb, []string{ipRateKey(ip, time.Now())}, size).Int64Slice()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return totals[0], totals[1], nil
+}
+
+// shardShift leaves the lower bits of a cluster cursor to the cursor of the master being scanned, the upper bits
+// count the masters done.
+const shardShift = 48
+
+// Scan runs one SCAN step. On a cluster the masters are scanned one after another in the order of their addresses,
+// keys may be missed or repeated should the topology change in between.
+func Scan(ctx context.Context, rdb redis.UniversalClient, cursor uint64, match string, count int64, typ string) ([]string, uint64, error) {
+	cluster, ok := rdb.(*redis.ClusterClient)
+	if !ok {
+		return rdb.ScanType(ctx, cursor, match, count, typ).Result()
+	}
+
+	masters, err := clusterMasters(ctx, cluster)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	shard, nodeCursor := cursor>>shardShift, cursor&(1<<shardShift-1)
+	if shard >= uint64(len(masters)) {
+		return []string{}, 0, nil
+	}
+
+	keys, next, err := masters[shard].ScanType(ctx, nodeCursor, match, count, typ).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if next == 0 {
+		if shard++; shard == uint64(len(masters)) {
+			return keys, 0, nil
+		}
+	}
+
+	return keys, shard<<shardShift | next, nil
+}
+
+func clusterMasters(ctx context.Context, cluster *redis.ClusterClient) ([]*redis.Client, error) {
+	lock := sync.Mutex{}
+	masters := make([]*redis.Client, 0)
+
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		masters = append(masters, client)
+		return nil
+	})
+
+	sort.Slice(masters, func(i, j int) bool {
+		return masters[i].Options().Addr < masters[j].Options().Addr
+	})
+
+	return masters, err
+}
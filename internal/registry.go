@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+)
+
+var (
+	// ErrNotFound is returned for connections whose record is gone.
+	ErrNotFound = errors.New("connection not found")
+	// ErrUnreadableLetter is returned for a dead letter that could not be decoded, it is put back at the end.
+	ErrUnreadableLetter = errors.New("unreadable dead letter")
+)
+
+// Registry holds what instances know about each other's connections: their records, the messages buffered for
+// detached ones and channel memberships. A record is a flat map of fields, see JoinRoute for what they are.
+type Registry interface {
+	// Register stores the record of a connection that joined, Refresh extends its expiry.
+	Register(ctx context.Context, id string, fields map[string]string, ttl time.Duration) error
+	Refresh(ctx context.Context, id string, ttl time.Duration) error
+	// Get returns an empty record for a connection that is gone, GetMany one record per id in the same order.
+	Get(ctx context.Context, id string) (map[string]string, error)
+	GetMany(ctx context.Context, ids []string) ([]map[string]string, error)
+	// List takes one step through all records. A page may hold fewer than count records even when the returned
+	// cursor is not zero yet, callers keep going until it is.
+	List(ctx context.Context, cursor uint64, count int64) ([]string, []map[string]string, uint64, error)
+	// Increment adds to numeric fields, the record of a connection that is gone is not brought back.
+	Increment(ctx context.Context, id string, counters map[string]int64) error
+	// Delete removes the record and buffer of a connection that left.
+	Delete(ctx context.Context, id string) error
+
+	// Detach marks the connection as disconnected for the grace window and returns the marker Expire needs to match.
+	Detach(ctx context.Context, id string, grace time.Duration) (string, error)
+	// Claim attaches a detached connection to an instance and returns the events buffered while it was away.
+	Claim(ctx context.Context, id, secret, instanceID string, ttl time.Duration) ([]Event, bool, error)
+	// Buffer keeps up to max events for a detached connection. When the connection is attached by then the owning
+	// instance is returned instead, ErrNotFound means the connection is gone.
+	Buffer(ctx context.Context, id string, event Event, max int64, grace time.Duration) (string, error)
+	// Expire removes a connection that was not resumed within the grace window. It reports false when the connection
+	// has been resumed or detached again since, in which case someone else is responsible for it.
+	Expire(ctx context.Context, id, left string) (bool, error)
+
+	Subscribe(ctx context.Context, route, channel, id string) error
+	Unsubscribe(ctx context.Context, route, channel, id string) error
+	Members(ctx context.Context, route, channel string) ([]string, error)
+	// Prune removes members whose connections turned out to be gone.
+	Prune(ctx context.Context, route, channel string, ids []string) error
+	// LeaveChannels removes the connection from every channel it is a member of.
+	LeaveChannels(ctx context.Context, id string) error
+}
+
+// DeadLetters keeps the newest client messages downstream did not take, in a list per route.
+type DeadLetters interface {
+	// Push appends to the list of the letter's route, keeping at most max letters there.
+	Push(ctx context.Context, letter DeadLetter, max int64) error
+	// Peek returns up to count letters of the route, oldest first.
+	Peek(ctx context.Context, route string, count int64) ([]DeadLetter, error)
+	// Pop takes the oldest letter of the route, false when there is none.
+	Pop(ctx context.Context, route string) (DeadLetter, bool, error)
+	Len(ctx context.Context, route string) (int64, error)
+	Purge(ctx context.Context, route string) error
+}
+
+// Limits backs the cluster wide limits on client addresses.
+type Limits interface {
+	// AcquireConnection takes one of max concurrent connection slots of the address, ReleaseConnection gives it back.
+	// Slots lapse after ttl unless refreshed, so the ones of an instance that died come back.
+	AcquireConnection(ctx context.Context, ip string, max int64, ttl time.Duration) (bool, error)
+	RefreshConnections(ctx context.Context, ip string, ttl time.Duration) error
+	ReleaseConnection(ctx context.Context, ip string) error
+	// CountMessage adds a message to the current second of the address and returns the message and byte totals of
+	// that second.
+	CountMessage(ctx context.Context, ip string, size int) (int64, int64, error)
+}
+
+// Backend is everything the instances of a cluster share.
+type Backend struct {
+	Registry    Registry
+	Bus         Bus
+	DeadLetters DeadLetters
+	Limits      Limits
+}
+
+// NewBackend picks the backend named by cfg.Backend, rdb is only used by "redis".
+func NewBackend(logger *slog.Logger, rdb redis.UniversalClient, instanceID string, cfg Config) (Backend, error) {
+	switch cfg.Backend {
+	case "", "redis":
+		return NewRedisBackend(logger, rdb, instanceID, cfg)
+	case "memory":
+		return NewMemoryBackend(), nil
+	default:
+		return Backend{}, fmt.Errorf("unknown backend %v", cfg.Backend)
+	}
+}
+
+func NewRedisBackend(logger *slog.Logger, rdb redis.UniversalClient, instanceID string, cfg Config) (Backend, error) {
+	// the instance ID names the channel of the instance on the bus
+	if strings.HasPrefix(instanceID, reservedPrefix) {
+		return Backend{}, fmt.Errorf("instance id %v must not start with %v", instanceID, reservedPrefix)
+	}
+
+	bus, err := NewBus(logger, rdb, instanceID, cfg)
+	if err != nil {
+		return Backend{}, err
+	}
+
+	store := &RedisStore{rdb: rdb}
+	return Backend{Registry: store, Bus: bus, DeadLetters: store, Limits: store}, nil
+}
+
+// NewMemoryBackend keeps everything in the process. It serves a single instance that has no Redis to talk to,
+// like an embedded gateway in tests or a small deployment.
+func NewMemoryBackend() Backend {
+	store := NewMemoryStore()
+	return Backend{Registry: store, Bus: instrumentedBus{NewMemoryBus()}, DeadLetters: store, Limits: store}
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func newResumeSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func resumeToken(id, secret string) string {
+	return fmt.Sprintf("%v.%v", id, secret)
+}
+
+func parseResumeToken(token string) (string, string, bool) {
+	i := strings.LastIndex(token, ".")
+	if i <= 0 || i == len(token)-1 {
+		return "", "", false
+	}
+
+	return token[:i], token[i+1:], true
+}
+
+// detachGrace is how long the records of a detached connection outlive the grace window, so the instance that
+// expires the connection still finds them.
+func detachGrace(grace time.Duration) time.Duration {
+	return grace + time.Minute
+}
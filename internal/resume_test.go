@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/ksuid"
+)
+
+func TestResume(t *testing.T) {
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" {
+		redisAddr = "localhost:6379"
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
+
+	t.Run("redis", func(t *testing.T) { testResume(t, &RedisStore{rdb: rdb}) })
+	t.Run("memory", func(t *testing.T) { testResume(t, NewMemoryStore()) })
+}
+
+func testResume(t *testing.T, registry Registry) {
+	ctx := context.Background()
+	cfg := Config{ResumeGrace: time.Minute, ResumeBuffer: 2}
+
+	id := ksuid.New().String()
+	secret, err := newResumeSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rid, rSecret, ok := parseResumeToken(resumeToken(id, secret)); !ok || rid != id || rSecret != secret {
+		t.Fatal("resume token does not round trip")
+	}
+
+	if _, err := registry.Buffer(ctx, id, Event{ID: id}, cfg.ResumeBuffer, cfg.ResumeGrace); err != ErrNotFound {
+		t.Fatal("buffered for an unknown connection")
+	}
+
+	if err := registry.Register(ctx, id, map[string]string{"inst": "a", "resume": secret}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if inst, err := registry.Buffer(ctx, id, Event{ID: id, Payload: "0"}, cfg.ResumeBuffer, cfg.ResumeGrace); err != nil || inst != "a" {
+		t.Fatal("attached connection should not be buffered")
+	}
+
+	left, err := registry.Detach(ctx, id, cfg.ResumeGrace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, payload := range []string{"1", "2", "3"} {
+		if inst, err := registry.Buffer(ctx, id, Event{ID: id, Payload: payload}, cfg.ResumeBuffer, cfg.ResumeGrace); err != nil || inst != "" {
+			t.Fatal("detached connection should be buffered")
+		}
+	}
+
+	if _, ok, err := registry.Claim(ctx, id, "wrong", "b", time.Minute); err != nil || ok {
+		t.Fatal("claimed with the wrong secret")
+	}
+
+	events, ok, err := registry.Claim(ctx, id, secret, "b", time.Minute)
+	if err != nil || !ok {
+		t.Fatal("failed to claim")
+	}
+
+	if len(events) != 2 || events[0].Payload != "2" || events[1].Payload != "3" {
+		t.Error("buffer not bounded or out of order")
+	}
+
+	if data, _ := registry.Get(ctx, id); data["inst"] != "b" {
+		t.Error("connection not attached to the new instance")
+	}
+
+	if expired, err := registry.Expire(ctx, id, left); err != nil || expired {
+		t.Error("expired a resumed connection")
+	}
+
+	if _, ok, err := registry.Claim(ctx, id, secret, "c", time.Minute); err != nil || ok {
+		t.Error("claimed an attached connection")
+	}
+
+	if err := registry.Increment(ctx, id, map[string]int64{"recv": 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := registry.Delete(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := registry.Increment(ctx, id, map[string]int64{"recv": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := registry.Get(ctx, id); len(data) != 0 {
+		t.Error("counting brought a deleted connection back")
+	}
+}
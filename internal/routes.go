@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/manualpilot/auth"
+	"golang.org/x/exp/slog"
+)
+
+// DefaultRoute is the name of the route to DOWNSTREAM_URL, it matches every join no other route claims.
+const DefaultRoute = "default"
+
+// Route sends the connections joining on a host and path prefix to their own downstream. Only that downstream's
+// key is accepted for requests that act on those connections.
+type Route[T any] struct {
+	Name       string
+	Host       string
+	Prefix     string
+	Downstream *Downstream[T]
+	Verifier   func(r *http.Request) (string, *T)
+}
+
+type Routes[T any] struct {
+	routes []*Route[T]
+}
+
+// NewRoutes builds the routing table from the default downstream and the configured routes, which are keyed by
+// "[host]/prefix". The public key of every downstream is fetched up front.
+func NewRoutes[T any](
+	logger *slog.Logger,
+	letters DeadLetters,
+	signer func(r *http.Request, id string, meta *T) error,
+	downstream string,
+	cfg Config,
+) (*Routes[T], error) {
+	targets := map[string]string{DefaultRoute: downstream}
+	for pattern, target := range cfg.Routes {
+		targets[pattern] = target
+	}
+
+	rs := &Routes[T]{routes: make([]*Route[T], 0, len(targets))}
+
+	for name, target := range targets {
+		route := &Route[T]{Name: name}
+		if name != DefaultRoute {
+			i := strings.Index(name, "/")
+			if i < 0 {
+				return nil, fmt.Errorf("route %v needs a path prefix", name)
+			}
+
+			route.Host, route.Prefix = name[:i], name[i:]
+		}
+
+		b, err := Get(fmt.Sprintf("%v/.well-known/public.txt", target), cfg.DownstreamTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Debug("downstream public key", slog.String("route", name), slog.String("public-key", string(b)))
+
+		downstreamKey := make([]byte, base64.RawURLEncoding.DecodedLen(len(b)))
+		if _, err := base64.RawURLEncoding.Decode(downstreamKey, b); err != nil {
+			return nil, err
+		}
+
+		route.Downstream = NewDownstream(name, target, signer, letters, cfg)
+		route.Verifier = auth.NewRequestVerifier[T](downstreamKey, "Websocket-Gateway-Auth")
+		rs.routes = append(rs.routes, route)
+	}
+
+	rs.sort()
+
+	return rs, nil
+}
+
+// sort orders routes bound to a host before ones that are not, then longer prefixes before shorter ones and the
+// default route last.
+func (rs *Routes[T]) sort() {
+	sort.Slice(rs.routes, func(i, j int) bool {
+		a, b := rs.routes[i], rs.routes[j]
+		if a.Name == DefaultRoute || b.Name == DefaultRoute {
+			return b.Name == DefaultRoute && a.Name != DefaultRoute
+		}
+
+		if (a.Host != "") != (b.Host != "") {
+			return a.Host != ""
+		}
+
+		return len(a.Prefix) > len(b.Prefix)
+	})
+}
+
+// Match picks the route for a join request.
+func (rs *Routes[T]) Match(r *http.Request) *Route[T] {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, route := range rs.routes {
+		if route.Name == DefaultRoute {
+			return route
+		}
+
+		if route.Host != "" && !strings.EqualFold(route.Host, host) {
+			continue
+		}
+
+		if r.URL.Path == route.Prefix || strings.HasPrefix(r.URL.Path, strings.TrimSuffix(route.Prefix, "/")+"/") {
+			return route
+		}
+	}
+
+	return nil
+}
+
+func (rs *Routes[T]) Get(name string) *Route[T] {
+	for _, route := range rs.routes {
+		if route.Name == name {
+			return route
+		}
+	}
+
+	return nil
+}
+
+// Domain picks the downstream that decides about a custom domain, the route bound to the host or the default one.
+func (rs *Routes[T]) Domain(name string) *Route[T] {
+	for _, route := range rs.routes {
+		if route.Host != "" && strings.EqualFold(route.Host, name) {
+			return route
+		}
+	}
+
+	return rs.Get(DefaultRoute)
+}
+
+// Verify finds the route whose downstream signed the request.
+func (rs *Routes[T]) Verify(r *http.Request) (string, *Route[T]) {
+	for _, route := range rs.routes {
+		if id, _ := route.Verifier(r); id != "" {
+			return id, route
+		}
+	}
+
+	return "", nil
+}
+
+func (rs *Routes[T]) Breakers() map[string]BreakerState {
+	states := make(map[string]BreakerState, len(rs.routes))
+	for _, route := range rs.routes {
+		states[route.Name] = route.Downstream.Breaker.State()
+	}
+
+	return states
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/manualpilot/auth"
+)
+
+func TestRoutesMatch(t *testing.T) {
+	routes := &Routes[any]{routes: []*Route[any]{
+		{Name: "/chat", Prefix: "/chat"},
+		{Name: "chat.example.com/chat/rooms", Host: "chat.example.com", Prefix: "/chat/rooms"},
+		{Name: "/chat/rooms", Prefix: "/chat/rooms"},
+		{Name: "chat.example.com/", Host: "chat.example.com", Prefix: "/"},
+		{Name: DefaultRoute},
+	}}
+	routes.sort()
+
+	cases := map[string]string{
+		"http://example.com/":                       DefaultRoute,
+		"http://example.com/chat":                   "/chat",
+		"http://example.com/chat/x":                 "/chat",
+		"http://example.com/chatter":                DefaultRoute,
+		"http://example.com/chat/rooms/1":           "/chat/rooms",
+		"http://chat.example.com:8443/chat/rooms/1": "chat.example.com/chat/rooms",
+		"http://chat.example.com/elsewhere":         "chat.example.com/",
+	}
+
+	for u, expected := range cases {
+		if route := routes.Match(httptest.NewRequest("GET", u, nil)); route == nil || route.Name != expected {
+			t.Errorf("%v should have matched %v", u, expected)
+		}
+	}
+}
+
+func TestRouteScope(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	routes := &Routes[any]{}
+	signers := make(map[string]func(r *http.Request, id string, meta *any) error)
+
+	for _, name := range []string{"/chat", DefaultRoute} {
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signers[name] = auth.NewRequestSigner[any](privateKey, "Websocket-Gateway-Auth")
+		routes.routes = append(routes.routes, &Route[any]{
+			Name:     name,
+			Verifier: auth.NewRequestVerifier[any](publicKey, "Websocket-Gateway-Auth"),
+		})
+	}
+
+	for name, id := range map[string]string{"/chat": "a", DefaultRoute: "b"} {
+		if err := store.Register(ctx, id, map[string]string{"inst": "i", "route": name}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.Push(ctx, DeadLetter{ID: id, Route: name}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := chi.NewRouter()
+	router.Get("/connections", ListHandler(store, routes))
+	router.Get("/connections/{id}", InspectHandler(store, routes))
+	router.Head("/connections/{id}", AliveHandler(store, routes))
+	router.Get("/dead-letters", DeadLettersHandler(store, routes))
+	router.Delete("/dead-letters", PurgeDeadLettersHandler(store, routes))
+
+	do := func(route, method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if err := signers[route](req, "admin", nil); err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	list := ConnectionList{}
+	if err := json.NewDecoder(do("/chat", http.MethodGet, "/connections").Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Connections) != 1 || list.Connections[0].ID != "a" {
+		t.Errorf("listed connections of another route %+v", list.Connections)
+	}
+
+	if rec := do("/chat", http.MethodGet, "/connections/b"); rec.Code != http.StatusNotFound {
+		t.Errorf("inspected a connection of another route, %v", rec.Code)
+	}
+
+	if rec := do("/chat", http.MethodHead, "/connections/b"); rec.Code != http.StatusNotFound {
+		t.Errorf("another route's connection is alive, %v", rec.Code)
+	}
+
+	if rec := do(DefaultRoute, http.MethodGet, "/connections/b"); rec.Code != http.StatusOK {
+		t.Errorf("failed to inspect an own connection, %v", rec.Code)
+	}
+
+	letters := make([]DeadLetter, 0)
+	if err := json.NewDecoder(do("/chat", http.MethodGet, "/dead-letters").Body).Decode(&letters); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(letters) != 1 || letters[0].ID != "a" {
+		t.Errorf("listed dead letters of another route %+v", letters)
+	}
+
+	if rec := do("/chat", http.MethodDelete, "/dead-letters"); rec.Code != http.StatusNoContent {
+		t.Fatalf("failed to purge, %v", rec.Code)
+	}
+
+	if left, _ := store.Peek(ctx, DefaultRoute, 10); len(left) != 1 {
+		t.Error("purged dead letters of another route")
+	}
+}
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/manualpilot/auth"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracePropagation(t *testing.T) {
+	provider := sdktrace.NewTracerProvider()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	ctx, span := tracer.Start(context.Background(), "test")
+	defer span.End()
+
+	// the trace survives the trip through the bus
+	event := Event{Type: EventTypeWrite, Trace: traceCarrier(ctx)}
+	if got := trace.SpanContextFromContext(eventContext(context.Background(), event)); got.TraceID() != span.SpanContext().TraceID() {
+		t.Error("trace not carried by the event")
+	}
+
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" {
+		redisAddr = "localhost:6379"
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traceparent := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("Traceparent")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	signer := auth.NewRequestSigner[any](privateKey, "Websocket-Gateway-Auth")
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
+	downstream := NewDownstream(DefaultRoute, server.URL, signer, &RedisStore{rdb: rdb}, Config{})
+
+	if err := downstream.Message(ctx, Session{ID: "a"}, false, []byte("traced")); err != nil {
+		t.Fatal(err)
+	}
+
+	carried := propagation.TraceContext{}.Extract(context.Background(), propagation.HeaderCarrier{"Traceparent": {<-traceparent}})
+	if trace.SpanContextFromContext(carried).TraceID() != span.SpanContext().TraceID() {
+		t.Error("traceparent not sent downstream")
+	}
+}
@@ -1,30 +1,145 @@
 package internal
 
 import (
+	"fmt"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type Message struct {
 	Drop   bool
 	Binary bool
 	Buffer []byte
+	// Written, when set, is told the outcome of writing Buffer to the socket.
+	Written func(err error)
+}
+
+type Connection struct {
+	*Queue
+	Route       string
+	Subprotocol string
 }
 
 type State struct {
 	Lock        sync.RWMutex
-	Connections map[string]chan Message
+	Connections map[string]*Connection
+
+	// draining is closed once the instance shuts down, active counts the joins still being served
+	draining  chan struct{}
+	drainOnce sync.Once
+	active    atomic.Int64
+}
+
+func NewState() *State {
+	return &State{
+		Connections: make(map[string]*Connection),
+		draining:    make(chan struct{}),
+	}
 }
 
 type EventType string
 
 const (
-	EventTypeWrite EventType = "write"
-	EventTypeDrop  EventType = "drop"
+	EventTypeWrite     EventType = "write"
+	EventTypeDrop      EventType = "drop"
+	EventTypeBroadcast EventType = "broadcast"
 )
 
+// reservedPrefix is kept from instance IDs, so channels of the gateway itself can not be taken for an instance's.
+const reservedPrefix = "wsg:"
+
+// broadcastChannel is the pub/sub channel every instance listens on in addition to its own.
+const broadcastChannel = reservedPrefix + "broadcast"
+
 type Event struct {
 	Type    EventType `json:"type"`
 	ID      string    `json:"id"`
+	IDs     []string  `json:"ids,omitempty"`
+	Route   string    `json:"route,omitempty"`
+	Exclude []string  `json:"exclude,omitempty"`
 	Binary  bool      `json:"binary"`
 	Payload string    `json:"payload"`
+	// Trace carries the traceparent of the request that caused the event.
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+// Delivery is the outcome of a write for one connection. Only connections of the instance that took the request get
+// the outcome of their queue, the others are reported as forwarded once the event is on the bus. The owning instance
+// does not report back, it offers the message to the queue without waiting and drops it when the queue is full.
+type Delivery string
+
+const (
+	DeliveryDelivered    Delivery = "delivered"
+	DeliveryForwarded    Delivery = "forwarded"
+	DeliveryBuffered     Delivery = "buffered"
+	DeliveryNotFound     Delivery = "not_found"
+	DeliveryDropped      Delivery = "dropped"
+	DeliveryTimeout      Delivery = "timeout"
+	DeliveryDisconnected Delivery = "disconnected"
+	DeliveryForbidden    Delivery = "forbidden"
+	DeliveryTooLarge     Delivery = "too_large"
+	// the registry or bus failed, only bulk writes report it rather than failing the whole request
+	DeliveryFailed Delivery = "failed"
+)
+
+// Status is the response code a single write reports for the outcome.
+func (d Delivery) Status() int {
+	switch d {
+	case DeliveryDelivered:
+		return http.StatusOK
+	case DeliveryForwarded:
+		return http.StatusCreated
+	case DeliveryBuffered:
+		return http.StatusAccepted
+	case DeliveryDropped:
+		return http.StatusTooManyRequests
+	case DeliveryTimeout:
+		return http.StatusGatewayTimeout
+	case DeliveryDisconnected:
+		return http.StatusGone
+	case DeliveryForbidden:
+		return http.StatusForbidden
+	case DeliveryTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case DeliveryFailed:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusNotFound
+	}
+}
+
+// BulkWrite is a single message addressed to many connections. Payload is base64url encoded like in Event.
+type BulkWrite struct {
+	IDs     []string `json:"ids"`
+	Binary  bool     `json:"binary"`
+	Payload string   `json:"payload"`
+}
+
+// Targets returns the connections a write event is addressed to.
+func (e Event) Targets() []string {
+	if e.ID != "" {
+		return append([]string{e.ID}, e.IDs...)
+	}
+
+	return e.IDs
+}
+
+// keys of a connection share the {id} hash tag, so scripts touching several of them work on Redis Cluster
+func connectionKey(id string) string {
+	return fmt.Sprintf("ws:{%v}", id)
+}
+
+func connectionID(key string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(key, "ws:{"), "}")
+}
+
+// channelKey scopes channels to a route, downstreams only ever see their own.
+func channelKey(route, name string) string {
+	return fmt.Sprintf("ch:%v:%v", route, name)
+}
+
+func membershipKey(id string) string {
+	return fmt.Sprintf("wsc:{%v}", id)
 }
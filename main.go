@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -19,13 +22,17 @@ import (
 )
 
 type Env struct {
-	Port          int                   `env:"PORT,default=8080"`
-	RedirectPort  int                   `env:"REDIRECT_PORT,default=9090"`
-	InstanceID    string                `env:"INSTANCE_ID,required"`
-	ServiceDomain string                `env:"SERVICE_DOMAIN,required"`
-	DownstreamURL string                `env:"DOWNSTREAM_URL,required"`
-	RedisURL      string                `env:"REDIS_URL,required"`
-	PrivateKey    envconfig.Base64Bytes `env:"PRIVATE_KEY,required"`
+	Port         int    `env:"PORT,default=8080"`
+	RedirectPort int    `env:"REDIRECT_PORT,default=9090"`
+	AdminPort    int    `env:"ADMIN_PORT,default=9091"`
+	InstanceID   string `env:"INSTANCE_ID,required"`
+	// ServiceDomains are comma separated and may hold wildcards, the first one is where plain HTTP is redirected to
+	// when the request names no usable host.
+	ServiceDomains []string              `env:"SERVICE_DOMAIN,required"`
+	DownstreamURL  string                `env:"DOWNSTREAM_URL,required"`
+	PrivateKey     envconfig.Base64Bytes `env:"PRIVATE_KEY,required"`
+	Redis          EnvRedis
+	Gateway        internal.Config
 }
 
 func doMain(logger *slog.Logger) error {
@@ -39,47 +46,90 @@ func doMain(logger *slog.Logger) error {
 
 	logger = logger.With(slog.String("instance", env.InstanceID))
 
-	rOpts, err := redis.ParseURL(env.RedisURL)
+	// a memory backend has no use for redis, certificates then stay on the local disk
+	var rdb redis.UniversalClient
+	if env.Gateway.Backend != "memory" {
+		if env.Redis.RedisURL == "" {
+			return errors.New("REDIS_URL is required")
+		}
+
+		client, err := redisClient(env.Redis)
+		if err != nil {
+			return err
+		}
+
+		if err := client.Ping(ctx).Err(); err != nil {
+			return err
+		}
+
+		rdb = client
+	}
+
+	backend, err := internal.NewBackend(logger, rdb, env.InstanceID, env.Gateway)
 	if err != nil {
 		return err
 	}
 
-	rdb := redis.NewClient(rOpts)
-	if err := rdb.Info(ctx).Err(); err != nil {
+	shutdownTracing, err := internal.SetupTracing(ctx, env.InstanceID, env.Gateway)
+	if err != nil {
 		return err
 	}
 
-	router, err := internal.Main(logger, ctx, env.InstanceID, rdb, env.PrivateKey, env.DownstreamURL, env.ServiceDomain)
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Error("failed to flush traces", err)
+		}
+	}()
+
+	gateway, err := internal.Main(logger, ctx, env.InstanceID, backend, env.PrivateKey, env.DownstreamURL, env.ServiceDomains, env.Gateway)
 	if err != nil {
 		return err
 	}
 
-	tlsConfig, err := TLSConfig(ctx, env.ServiceDomain, rdb)
+	tlsConfig, challenges, err := TLSConfig(ctx, logger, env, rdb, gateway.AllowDomain)
 	if err != nil {
 		return err
 	}
 
 	server := &http.Server{
 		Addr:      fmt.Sprintf(":%v", env.Port),
-		Handler:   router,
+		Handler:   gateway.Router,
 		TLSConfig: tlsConfig,
 		// TODO: we actually only want to discard TLS handshake errors as they are caused by automated scanners
 		ErrorLog: log.New(io.Discard, "", 0),
 	}
 
-	redirect := &http.Server{
-		Addr: fmt.Sprintf(":%v", env.RedirectPort),
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			u := fmt.Sprintf("https://%v%v", env.ServiceDomain, r.RequestURI)
-			http.Redirect(w, r, u, http.StatusTemporaryRedirect)
-		}),
+	// without TLS there is nothing to redirect to, whatever sits in front of the gateway takes care of it
+	var redirect *http.Server
+	if tlsConfig != nil {
+		redirect = &http.Server{
+			Addr: fmt.Sprintf(":%v", env.RedirectPort),
+			Handler: challenges(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				u := fmt.Sprintf("https://%v%v", redirectHost(r, env.ServiceDomains[0]), r.RequestURI)
+				http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+			})),
+		}
+	}
+
+	// metrics are kept off the public port
+	admin := &http.Server{
+		Addr:    fmt.Sprintf(":%v", env.AdminPort),
+		Handler: internal.AdminRouter(),
 	}
 
 	defer func() {
-		ctx, rCancel := context.WithTimeout(context.Background(), 1*time.Minute)
-		defer rCancel()
-		if err := redirect.Shutdown(ctx); err != nil {
-			logger.Error("failed to shutdown redirect server", err)
+		ctx, aCancel := context.WithTimeout(context.Background(), 1*time.Minute)
+		defer aCancel()
+		if err := admin.Shutdown(ctx); err != nil {
+			logger.Error("failed to shutdown admin server", err)
+		}
+
+		if redirect != nil {
+			ctx, rCancel := context.WithTimeout(context.Background(), 1*time.Minute)
+			defer rCancel()
+			if err := redirect.Shutdown(ctx); err != nil {
+				logger.Error("failed to shutdown redirect server", err)
+			}
 		}
 
 		ctx, sCancel := context.WithTimeout(context.Background(), 1*time.Minute)
@@ -94,23 +144,43 @@ func doMain(logger *slog.Logger) error {
 	ec := make(chan error)
 
 	go func() {
-		if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		listen := server.ListenAndServe
+		if tlsConfig != nil {
+			listen = func() error { return server.ListenAndServeTLS("", "") }
+		}
+
+		if err := listen(); err != nil && err != http.ErrServerClosed {
 			ec <- err
 		}
 	}()
 
+	if redirect != nil {
+		go func() {
+			if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				ec <- err
+			}
+		}()
+	}
+
 	go func() {
-		if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			ec <- err
 		}
 	}()
 
-	sc := make(chan os.Signal)
+	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
 
 	select {
 	case sig := <-sc:
 		logger.Warn("shutdown signal", slog.String("signal", sig.String()))
+
+		// server.Shutdown does not know about hijacked connections, they are closed here
+		dCtx, dCancel := context.WithTimeout(context.Background(), env.Gateway.DrainTimeout)
+		defer dCancel()
+		if err := gateway.Drain(dCtx); err != nil {
+			logger.Error("failed to drain connections", err)
+		}
 	case err := <-ec:
 		logger.Error("failed to start http server", err)
 	}
@@ -118,6 +188,21 @@ func doMain(logger *slog.Logger) error {
 	return nil
 }
 
+// redirectHost keeps the host the client asked for, custom domains stay on themselves. Addresses and wildcards are
+// no place to send a browser to.
+func redirectHost(r *http.Request, fallback string) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if host == "" || net.ParseIP(host) != nil {
+		host = fallback
+	}
+
+	return strings.TrimPrefix(host, "*.")
+}
+
 func main() {
 	handler := slog.HandlerOptions{AddSource: true, Level: slog.LevelDebug}
 	logger := slog.New(handler.NewJSONHandler(os.Stdout))
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// EnvRedis describes the Redis deployment. REDIS_URL carries the credentials and database in every mode, a cluster
+// takes further seed nodes as addr query parameters. Sentinel asks REDIS_SENTINEL_ADDRS for the primary of
+// REDIS_MASTER_NAME.
+type EnvRedis struct {
+	RedisMode             string   `env:"REDIS_MODE,default=single"`
+	RedisURL              string   `env:"REDIS_URL"`
+	RedisMasterName       string   `env:"REDIS_MASTER_NAME"`
+	RedisSentinelAddrs    []string `env:"REDIS_SENTINEL_ADDRS"`
+	RedisSentinelPassword string   `env:"REDIS_SENTINEL_PASSWORD"`
+}
+
+func redisClient(env EnvRedis) (redis.UniversalClient, error) {
+	switch env.RedisMode {
+	case "", "single":
+		opts, err := redis.ParseURL(env.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+
+		return redis.NewClient(opts), nil
+	case "cluster":
+		opts, err := redis.ParseClusterURL(env.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+
+		return redis.NewClusterClient(opts), nil
+	case "sentinel":
+		opts, err := redis.ParseURL(env.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       env.RedisMasterName,
+			SentinelAddrs:    env.RedisSentinelAddrs,
+			SentinelPassword: env.RedisSentinelPassword,
+			Username:         opts.Username,
+			Password:         opts.Password,
+			DB:               opts.DB,
+			TLSConfig:        opts.TLSConfig,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown redis mode %v", env.RedisMode)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// selfSigned issues certificates for whatever name a client asks for from a local CA. It is meant for development,
+// the CA certificate at path has to be trusted by the clients.
+type selfSigned struct {
+	path  string
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+
+	lock  sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+func newSelfSigned(dir string) (*selfSigned, error) {
+	s := &selfSigned{
+		path:  filepath.Join(dir, "ca.pem"),
+		certs: make(map[string]*tls.Certificate),
+	}
+
+	keyPath := filepath.Join(dir, "ca-key.pem")
+
+	bCert, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, s.createCA(dir, keyPath)
+	} else if err != nil {
+		return nil, err
+	}
+
+	bKey, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	certBlock, _ := pem.Decode(bCert)
+	keyBlock, _ := pem.Decode(bKey)
+	if certBlock == nil || keyBlock == nil {
+		return nil, errors.New("unreadable development CA")
+	}
+
+	if s.ca, err = x509.ParseCertificate(certBlock.Bytes); err != nil {
+		return nil, err
+	}
+
+	if s.caKey, err = x509.ParseECPrivateKey(keyBlock.Bytes); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *selfSigned) createCA(dir, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "wsg development CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	bKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: bKey}), 0o600); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(s.path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return err
+	}
+
+	s.ca, err = x509.ParseCertificate(der)
+	s.caKey = key
+	return err
+}
+
+func (s *selfSigned) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// clients do not send the name when connecting to an address
+	name := hello.ServerName
+	if name == "" && hello.Conn != nil {
+		name, _, _ = net.SplitHostPort(hello.Conn.LocalAddr().String())
+	}
+
+	if name == "" {
+		name = "localhost"
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if cert, ok := s.certs[name]; ok && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	cert, err := s.issue(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.certs[name] = cert
+	return cert, nil
+}
+
+func (s *selfSigned) issue(name string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, 30),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca, &key.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der, s.ca.Raw}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
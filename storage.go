@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bsm/redislock"
+	"github.com/caddyserver/certmagic"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
+
+	"manualpilot/wsg/internal"
+)
+
+const (
+	// lockTTL is how long a lock outlives an instance that died holding it, it is refreshed while held.
+	lockTTL   = 1 * time.Minute
+	lockRetry = 1 * time.Second
+	scanCount = 100
+)
+
+// storage keeps certmagic's keys as hashes in redis. Keys are paths, "directories" only exist through the keys
+// below them. Values are encrypted when there are keys.
+type storage struct {
+	rdb    redis.UniversalClient
+	locker *redislock.Client
+	logger *slog.Logger
+	keys   *keyring
+	prefix string
+	ttl    time.Duration
+	locks  sync.Map
+}
+
+type heldLock struct {
+	lock *redislock.Lock
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// newStorage puts the keys below "tls:", or "<namespace>:tls:" so several deployments can share a redis.
+func newStorage(logger *slog.Logger, rdb redis.UniversalClient, namespace string, keys *keyring) *storage {
+	prefix := "tls:"
+	if namespace != "" {
+		prefix = namespace + ":" + prefix
+	}
+
+	return &storage{
+		rdb:    rdb,
+		locker: redislock.New(rdb),
+		logger: logger,
+		keys:   keys,
+		prefix: prefix,
+		ttl:    lockTTL,
+		locks:  sync.Map{},
+	}
+}
+
+func (s *storage) key(key string) string {
+	return s.prefix + key
+}
+
+// lockKey lives outside the prefix of the keys, so locks never show up in List.
+func (s *storage) lockKey(name string) string {
+	return strings.TrimSuffix(s.prefix, ":") + "-lock:" + name
+}
+
+// Lock blocks until the lock is obtained or ctx is done. certmagic may hold a lock for longer than its TTL while it
+// waits on the CA, so it is refreshed until Unlock.
+func (s *storage) Lock(ctx context.Context, name string) error {
+	for {
+		opts := &redislock.Options{RetryStrategy: redislock.LinearBackoff(lockRetry)}
+
+		lock, err := s.locker.Obtain(ctx, s.lockKey(name), s.ttl, opts)
+		if errors.Is(err, redislock.ErrNotObtained) && ctx.Err() == nil {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		rCtx, stop := context.WithCancel(context.Background())
+		held := &heldLock{lock: lock, stop: stop, done: make(chan struct{})}
+		go s.refresh(rCtx, name, held)
+
+		s.locks.Store(name, held)
+		return nil
+	}
+}
+
+func (s *storage) refresh(ctx context.Context, name string, held *heldLock) {
+	defer close(held.done)
+
+	ticker := time.NewTicker(s.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := held.lock.Refresh(ctx, s.ttl, nil)
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+
+		s.logger.Error("failed to refresh lock", err, slog.String("lock", name))
+
+		// someone else holds it by now
+		if errors.Is(err, redislock.ErrNotObtained) {
+			return
+		}
+	}
+}
+
+func (s *storage) Unlock(ctx context.Context, name string) error {
+	held, ok := s.locks.LoadAndDelete(name)
+	if !ok {
+		return fmt.Errorf("no lock for %v", name)
+	}
+
+	held.(*heldLock).stop()
+	<-held.(*heldLock).done
+
+	return held.(*heldLock).lock.Release(ctx)
+}
+
+// Store replaces the whole hash, fields of an earlier encryption must not stay behind.
+func (s *storage) Store(ctx context.Context, key string, value []byte) error {
+	hashmap, err := s.entry(key, value, time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, s.key(key))
+		pipe.HSet(ctx, s.key(key), hashmap)
+		return nil
+	})
+
+	return err
+}
+
+func (s *storage) Load(ctx context.Context, key string) ([]byte, error) {
+	res, err := s.rdb.HMGet(ctx, s.key(key), "data", "key", "data-key").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if res[0] == nil {
+		return nil, fs.ErrNotExist
+	}
+
+	return s.open(key, res)
+}
+
+// entry is the hash of a value. "key" names the version of the key that wrapped "data-key", entries without it are
+// not encrypted.
+func (s *storage) entry(key string, value []byte, modified time.Time) (map[string]any, error) {
+	hashmap := map[string]any{
+		"modified": modified.Unix(),
+		"size":     len(value),
+	}
+
+	if s.keys == nil {
+		hashmap["data"] = base64.RawURLEncoding.EncodeToString(value)
+		return hashmap, nil
+	}
+
+	sealed, err := s.keys.seal(key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	hashmap["data"] = base64.RawURLEncoding.EncodeToString(sealed.data)
+	hashmap["data-key"] = base64.RawURLEncoding.EncodeToString(sealed.dataKey)
+	hashmap["key"] = sealed.version
+
+	return hashmap, nil
+}
+
+// open takes the data, key and data-key fields of an entry.
+func (s *storage) open(key string, fields []any) ([]byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(fields[0].(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if fields[1] == nil {
+		return data, nil
+	}
+
+	if s.keys == nil {
+		return nil, fmt.Errorf("%v is encrypted, no storage keys are set", key)
+	}
+
+	dataKey, err := base64.RawURLEncoding.DecodeString(fields[2].(string))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.keys.open(key, sealed{version: fields[1].(string), dataKey: dataKey, data: data})
+}
+
+// Delete removes the key and everything below it.
+func (s *storage) Delete(ctx context.Context, key string) error {
+	keys, err := s.scan(ctx, key, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, s.key(key))
+		for _, k := range keys {
+			pipe.Del(ctx, s.key(k))
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+func (s *storage) Exists(ctx context.Context, key string) bool {
+	res, err := s.rdb.Exists(ctx, s.key(key)).Result()
+	if err != nil {
+		return false
+	} else if res > 0 {
+		return true
+	}
+
+	keys, err := s.scan(ctx, key, 1)
+	return err == nil && len(keys) > 0
+}
+
+// List returns the keys directly below prefix, including directories, or all keys and directories below it when
+// recursive.
+func (s *storage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	dir := strings.Trim(prefix, "/")
+
+	keys, err := s.scan(ctx, dir, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, fs.ErrNotExist
+	}
+
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimPrefix(key[len(dir):], "/"), "/")
+		if !recursive {
+			parts = parts[:1]
+		}
+
+		for i := range parts {
+			name := path.Join(dir, strings.Join(parts[:i+1], "/"))
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (s *storage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	info := certmagic.KeyInfo{Key: key}
+
+	res, err := s.rdb.HMGet(ctx, s.key(key), "modified", "size").Result()
+	if err != nil {
+		return info, err
+	}
+
+	// HMGET answers nils for a missing key, it may still be a directory
+	if res[0] == nil || res[1] == nil {
+		if !s.Exists(ctx, key) {
+			return info, fs.ErrNotExist
+		}
+
+		return info, nil
+	}
+
+	modified, err := strconv.Atoi(res[0].(string))
+	if err != nil {
+		return info, err
+	}
+
+	size, err := strconv.Atoi(res[1].(string))
+	if err != nil {
+		return info, err
+	}
+
+	info.Modified = time.Unix(int64(modified), 0)
+	info.Size = int64(size)
+	info.IsTerminal = true
+
+	return info, nil
+}
+
+// reencrypt rewrites the entries that are not encrypted with the current key, whether stored as they are or under an
+// older key, and returns how many it rewrote. It holds a lock, so instances starting together do not all do it.
+func (s *storage) reencrypt(ctx context.Context) (int, error) {
+	if s.keys == nil {
+		return 0, errors.New("no storage keys are set")
+	}
+
+	if err := s.Lock(ctx, "reencrypt"); err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err := s.Unlock(context.Background(), "reencrypt"); err != nil {
+			s.logger.Error("failed to unlock", err, slog.String("lock", "reencrypt"))
+		}
+	}()
+
+	keys, err := s.scan(ctx, "", 0)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, key := range keys {
+		rewritten, err := s.reencryptKey(ctx, key)
+		if err != nil {
+			return count, fmt.Errorf("%v: %w", key, err)
+		}
+
+		if rewritten {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (s *storage) reencryptKey(ctx context.Context, key string) (bool, error) {
+	rewritten := false
+
+	err := s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+		res, err := tx.HMGet(ctx, s.key(key), "data", "key", "data-key", "modified").Result()
+		if err != nil {
+			return err
+		}
+
+		if res[0] == nil || res[1] == s.keys.current {
+			return nil
+		}
+
+		value, err := s.open(key, res)
+		if err != nil {
+			return err
+		}
+
+		modified := time.Now()
+		if res[3] != nil {
+			seconds, err := strconv.ParseInt(res[3].(string), 10, 64)
+			if err != nil {
+				return err
+			}
+
+			modified = time.Unix(seconds, 0)
+		}
+
+		hashmap, err := s.entry(key, value, modified)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, s.key(key))
+			pipe.HSet(ctx, s.key(key), hashmap)
+			return nil
+		})
+
+		rewritten = err == nil
+		return err
+	}, s.key(key))
+
+	// stored again in between, which encrypted it with the current key
+	if err == redis.TxFailedErr {
+		return false, nil
+	}
+
+	return rewritten, err
+}
+
+// scan returns the keys below dir without the prefix, all of them when limit is zero.
+func (s *storage) scan(ctx context.Context, dir string, limit int) ([]string, error) {
+	match := s.prefix + escapeGlob(dir) + "/*"
+	if dir == "" {
+		match = s.prefix + "*"
+	}
+
+	keys := make([]string, 0)
+	cursor := uint64(0)
+
+	for {
+		res, next, err := internal.Scan(ctx, s.rdb, cursor, match, scanCount, "hash")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range res {
+			keys = append(keys, strings.TrimPrefix(key, s.prefix))
+		}
+
+		if cursor = next; cursor == 0 || (limit > 0 && len(keys) >= limit) {
+			return keys, nil
+		}
+	}
+}
+
+// escapeGlob keeps characters of a key from being taken as part of the MATCH pattern.
+func escapeGlob(s string) string {
+	b := strings.Builder{}
+	for _, r := range s {
+		if strings.ContainsRune(`\*?[]`, r) {
+			b.WriteRune('\\')
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
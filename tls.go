@@ -3,139 +3,200 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"encoding/base64"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"io/fs"
-	"strconv"
-	"sync"
-	"time"
+	"net/http"
+	"os"
 
-	"github.com/bsm/redislock"
 	"github.com/caddyserver/certmagic"
-	"github.com/libdns/porkbun"
 	"github.com/redis/go-redis/v9"
 	"github.com/sethvargo/go-envconfig"
+	"golang.org/x/exp/slog"
 )
 
-type storage struct {
-	rdb    *redis.Client
-	locker *redislock.Client
-	locks  sync.Map
+type EnvTLS struct {
+	// TLSMode is "acme", "files", "selfsigned" or "off". The latter serves plain HTTP, for running behind a proxy that
+	// terminates TLS.
+	TLSMode string `env:"TLS_MODE,default=acme"`
+	// ACMEChallenges lists the challenges "acme" may solve: "dns-01" through DNSProvider, "http-01" on the redirect
+	// server and "tls-alpn-01" on the main listener. ACMEDirectory defaults to Let's Encrypt, ACMECARoot is a PEM file
+	// to trust for talking to it, like the one of a local Pebble.
+	ACMEChallenges []string `env:"ACME_CHALLENGES,default=dns-01"`
+	ACMEDirectory  string   `env:"ACME_DIRECTORY"`
+	ACMECARoot     string   `env:"ACME_CA_ROOT"`
+	ACMEEmail      string   `env:"ACME_EMAIL"`
+	DNSProvider    string   `env:"DNS_PROVIDER,default=porkbun"`
+	// OnDemandTLS obtains certificates for domains other than the service domains during the first handshake, once
+	// downstream agrees to the domain.
+	OnDemandTLS bool `env:"ON_DEMAND_TLS,default=false"`
+	// TLSStorageNamespace prefixes the keys of certificates in redis, for deployments sharing one.
+	TLSStorageNamespace string `env:"TLS_STORAGE_NAMESPACE"`
+	// TLSStorageKeys encrypt certificates and keys in redis, "version:base64 key" with 32 byte keys, the first one is
+	// used for new entries. They can also come from TLSStorageKeysFile. To rotate, put a new key first and set
+	// TLSStorageReencrypt, which rewrites entries under older keys or without encryption on start.
+	TLSStorageKeys      []string `env:"TLS_STORAGE_KEYS"`
+	TLSStorageKeysFile  string   `env:"TLS_STORAGE_KEYS_FILE"`
+	TLSStorageReencrypt bool     `env:"TLS_STORAGE_REENCRYPT,default=false"`
+	// TLSCertFile and TLSKeyFile are PEM files, they are reloaded when they change on disk.
+	TLSCertFile string `env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `env:"TLS_KEY_FILE"`
+	// TLSCADir keeps the development CA of "selfsigned" across restarts, so it only has to be trusted once.
+	TLSCADir string `env:"TLS_CA_DIR,default=.tls"`
 }
 
-func (s *storage) Lock(ctx context.Context, name string) error {
-	opts := &redislock.Options{
-		RetryStrategy: redislock.LinearBackoff(1 * time.Minute),
+// TLSConfig returns nil when TLS is off. The returned middleware answers HTTP-01 challenges on the redirect server.
+// allowDomain decides about on-demand certificates.
+func TLSConfig(
+	ctx context.Context,
+	logger *slog.Logger,
+	env Env,
+	rdb redis.UniversalClient,
+	allowDomain func(ctx context.Context, name string) error,
+) (*tls.Config, func(http.Handler) http.Handler, error) {
+	envTLS := EnvTLS{}
+	if err := envconfig.Process(ctx, &envTLS); err != nil {
+		return nil, nil, err
 	}
 
-	lock, err := s.locker.Obtain(ctx, fmt.Sprintf("tls:lock:%v", name), 1*time.Minute, opts)
-	if err != nil {
-		return err
+	noChallenges := func(h http.Handler) http.Handler { return h }
+
+	switch envTLS.TLSMode {
+	case "", "acme":
+		return acmeConfig(ctx, logger, envTLS, env, rdb, allowDomain)
+	case "files":
+		if envTLS.TLSCertFile == "" || envTLS.TLSKeyFile == "" {
+			return nil, nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE are required")
+		}
+
+		cert, err := newCertFile(ctx, logger, envTLS.TLSCertFile, envTLS.TLSKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return &tls.Config{GetCertificate: cert.GetCertificate, NextProtos: []string{"h2", "http/1.1"}}, noChallenges, nil
+	case "selfsigned":
+		ca, err := newSelfSigned(envTLS.TLSCADir)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		logger.Warn("serving certificates of a development CA", slog.String("ca", ca.path))
+		return &tls.Config{GetCertificate: ca.GetCertificate, NextProtos: []string{"h2", "http/1.1"}}, noChallenges, nil
+	case "off":
+		return nil, noChallenges, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown tls mode %v", envTLS.TLSMode)
 	}
-
-	s.locks.Store(name, lock)
-	return nil
 }
 
-func (s *storage) Unlock(ctx context.Context, name string) error {
-	lock, ok := s.locks.LoadAndDelete(name)
-	if !ok {
-		return fmt.Errorf("no lock for %v", name)
+// acmeIssuer describes how certificates are obtained. Listeners for HTTP-01 and TLS-ALPN-01 are only started by
+// certmagic while ours are not up yet, later on the redirect server and the main listener answer the challenges.
+func acmeIssuer(ctx context.Context, envTLS EnvTLS, env Env) (certmagic.ACMEIssuer, error) {
+	issuer := certmagic.DefaultACME
+	issuer.Agreed = true
+	issuer.Email = envTLS.ACMEEmail
+	issuer.DisableHTTPChallenge = true
+	issuer.DisableTLSALPNChallenge = true
+	issuer.AltHTTPPort = env.RedirectPort
+	issuer.AltTLSALPNPort = env.Port
+
+	if envTLS.ACMEDirectory != "" {
+		issuer.CA, issuer.TestCA = envTLS.ACMEDirectory, envTLS.ACMEDirectory
 	}
 
-	return lock.(*redislock.Lock).Release(ctx)
-}
+	if envTLS.ACMECARoot != "" {
+		b, err := os.ReadFile(envTLS.ACMECARoot)
+		if err != nil {
+			return issuer, err
+		}
 
-func (s *storage) Store(ctx context.Context, key string, value []byte) error {
-	hashmap := map[string]any{
-		"modified": time.Now().Unix(),
-		"data":     base64.RawURLEncoding.EncodeToString(value),
-		"size":     len(value),
+		issuer.TrustedRoots = x509.NewCertPool()
+		if !issuer.TrustedRoots.AppendCertsFromPEM(b) {
+			return issuer, fmt.Errorf("no certificates in %v", envTLS.ACMECARoot)
+		}
 	}
 
-	return s.rdb.HSet(ctx, fmt.Sprintf("tls:%v", key), hashmap).Err()
-}
-
-func (s *storage) Load(ctx context.Context, key string) ([]byte, error) {
-	res, err := s.rdb.HGet(ctx, fmt.Sprintf("tls:%v", key), "data").Result()
-	if err != nil && err != redis.Nil {
-		return nil, err
-	} else if err == redis.Nil {
-		return nil, fs.ErrNotExist
+	for _, challenge := range envTLS.ACMEChallenges {
+		switch challenge {
+		case "dns-01":
+			provider, err := dnsProvider(ctx, envTLS.DNSProvider)
+			if err != nil {
+				return issuer, err
+			}
+
+			issuer.DNS01Solver = &certmagic.DNS01Solver{DNSProvider: provider}
+		case "http-01":
+			issuer.DisableHTTPChallenge = false
+		case "tls-alpn-01":
+			issuer.DisableTLSALPNChallenge = false
+		default:
+			return issuer, fmt.Errorf("unknown acme challenge %v", challenge)
+		}
 	}
 
-	return base64.RawURLEncoding.DecodeString(res)
+	return issuer, nil
 }
 
-func (s *storage) Delete(ctx context.Context, key string) error {
-	return s.rdb.Del(ctx, fmt.Sprintf("tls:%v", key)).Err()
-}
-
-func (s *storage) Exists(ctx context.Context, key string) bool {
-	res, err := s.rdb.Exists(ctx, fmt.Sprintf("tls:%v", key)).Result()
-	return err != nil && res > 0
-}
-
-func (s *storage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
-	pattern := fmt.Sprintf("tls:%v", prefix)
-	if recursive {
-		pattern = fmt.Sprintf("%v*", pattern)
+func acmeConfig(
+	ctx context.Context,
+	logger *slog.Logger,
+	envTLS EnvTLS,
+	env Env,
+	rdb redis.UniversalClient,
+	allowDomain func(ctx context.Context, name string) error,
+) (*tls.Config, func(http.Handler) http.Handler, error) {
+	issuer, err := acmeIssuer(ctx, envTLS, env)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return s.rdb.Keys(ctx, pattern).Result()
-}
+	// renewals build their config from the defaults, so the issuer is set up there
+	certmagic.DefaultACME = issuer
 
-func (s *storage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
-	info := certmagic.KeyInfo{}
+	if rdb != nil {
+		keys, err := newKeyring(envTLS)
+		if err != nil {
+			return nil, nil, err
+		}
 
-	res, err := s.rdb.HMGet(ctx, fmt.Sprintf("tls:%v", key), "modified", "size").Result()
-	if err != nil && err != redis.Nil {
-		return info, err
-	} else if err == redis.Nil {
-		return info, fs.ErrNotExist
-	}
+		if keys == nil {
+			logger.Warn("certificates are stored unencrypted, set TLS_STORAGE_KEYS")
+		}
 
-	modified, err := strconv.Atoi(res[0].(string))
-	if err != nil {
-		return info, err
-	}
+		store := newStorage(logger, rdb, envTLS.TLSStorageNamespace, keys)
 
-	size, err := strconv.Atoi(res[1].(string))
-	if err != nil {
-		return info, err
-	}
+		if envTLS.TLSStorageReencrypt {
+			count, err := store.reencrypt(ctx)
+			if err != nil {
+				return nil, nil, err
+			}
 
-	info.Key = key
-	info.Modified = time.Unix(int64(modified), 0)
-	info.Size = int64(size)
-	info.IsTerminal = true
-
-	return info, nil
-}
-
-type EnvTLS struct {
-	PorkbunAPIKey    string `env:"PORKBUN_API_KEY,required"`
-	PorkbunAPISecret string `env:"PORKBUN_API_SECRET,required"`
-}
+			logger.Warn("re-encrypted certificate storage", slog.Int("entries", count))
+		}
 
-func TLSConfig(ctx context.Context, domain string, rdb *redis.Client) (*tls.Config, error) {
-	env := EnvTLS{}
-	if err := envconfig.Process(ctx, &env); err != nil {
-		return nil, err
+		certmagic.Default.Storage = store
 	}
 
-	certmagic.DefaultACME.DNS01Solver = &certmagic.DNS01Solver{
-		DNSProvider: &porkbun.Provider{
-			APIKey:       env.PorkbunAPIKey,
-			APISecretKey: env.PorkbunAPISecret,
-		},
+	// renewals of on-demand certificates ask again, a domain downstream dropped is not renewed
+	if envTLS.OnDemandTLS {
+		certmagic.Default.OnDemand = &certmagic.OnDemandConfig{
+			DecisionFunc: func(name string) error {
+				if err := allowDomain(ctx, name); err != nil {
+					logger.Warn("domain denied", slog.String("domain", name), slog.String("error", err.Error()))
+					return err
+				}
+
+				return nil
+			},
+		}
 	}
 
-	certmagic.Default.Storage = &storage{
-		rdb:    rdb,
-		locker: redislock.New(rdb),
-		locks:  sync.Map{},
+	cfg := certmagic.NewDefault()
+	if err := cfg.ManageSync(ctx, env.ServiceDomains); err != nil {
+		return nil, nil, err
 	}
 
-	return certmagic.TLS([]string{domain})
+	challenges := cfg.Issuers[0].(*certmagic.ACMEIssuer).HTTPChallengeHandler
+	return cfg.TLSConfig(), challenges, nil
 }
@@ -3,13 +3,18 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"os"
-	"sync"
+	"path/filepath"
 	"testing"
+	"time"
 
-	"github.com/bsm/redislock"
 	"github.com/caddyserver/certmagic"
 	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
 )
 
 func TestTLS(t *testing.T) {
@@ -19,13 +24,8 @@ func TestTLS(t *testing.T) {
 	}
 
 	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
-	rlock := redislock.New(rdb)
 
-	certmagic.Default.Storage = &storage{
-		rdb:    rdb,
-		locker: rlock,
-		locks:  sync.Map{},
-	}
+	certmagic.Default.Storage = newStorage(slog.Default(), rdb, "", nil)
 
 	ctx := context.Background()
 	domain := "example.com"
@@ -52,3 +52,140 @@ func TestTLS(t *testing.T) {
 		t.Fatalf("keys not equal")
 	}
 }
+
+func TestSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, err := newSelfSigned(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart keeps the CA clients were told to trust
+	ca, err = newSelfSigned(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: "wsg.localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(b)
+
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: "wsg.localhost", Roots: roots}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCertFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	ca, err := newSelfSigned(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name string, modified time.Time) {
+		cert, err := ca.issue(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, path := range []string{certPath, keyPath} {
+			if err := os.Chtimes(path, modified, modified); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	served := func(c *certFile) string {
+		cert, _ := c.GetCertificate(nil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return leaf.Subject.CommonName
+	}
+
+	write("old.localhost", time.Now().Add(-time.Minute))
+
+	handler := slog.HandlerOptions{AddSource: true}
+	c, err := newCertFile(ctx, slog.New(handler.NewTextHandler(os.Stdout)), certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name := served(c); name != "old.localhost" {
+		t.Fatalf("serving %v", name)
+	}
+
+	write("new.localhost", time.Now())
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if name := served(c); name != "new.localhost" {
+		t.Errorf("renewed certificate not picked up, serving %v", name)
+	}
+}
+
+func TestACMEIssuer(t *testing.T) {
+	ctx := context.Background()
+	env := Env{Port: 8443, RedirectPort: 8080}
+
+	envTLS := EnvTLS{
+		ACMEChallenges: []string{"http-01", "tls-alpn-01"},
+		ACMEDirectory:  "https://localhost:14000/dir",
+	}
+
+	issuer, err := acmeIssuer(ctx, envTLS, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if issuer.DisableHTTPChallenge || issuer.DisableTLSALPNChallenge || issuer.DNS01Solver != nil {
+		t.Error("challenges not picked as configured")
+	}
+
+	if issuer.AltHTTPPort != 8080 || issuer.AltTLSALPNPort != 8443 {
+		t.Error("challenges not answered on the listeners")
+	}
+
+	if issuer.CA != envTLS.ACMEDirectory || issuer.TestCA != envTLS.ACMEDirectory {
+		t.Error("directory not used")
+	}
+
+	if _, err := acmeIssuer(ctx, EnvTLS{ACMEChallenges: []string{"dns-01"}, DNSProvider: "nope"}, env); err == nil {
+		t.Error("unknown dns provider accepted")
+	}
+
+	if _, err := acmeIssuer(ctx, EnvTLS{ACMEChallenges: []string{"smtp-01"}}, env); err == nil {
+		t.Error("unknown challenge accepted")
+	}
+}